@@ -11,26 +11,53 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	ttl  = time.Hour * 24 * 365 * 100
-	keys []*fernet.Key
+	ttl = time.Hour * 24 * 365 * 100
+	// Holds a []*fernet.Key. Swapped as a whole
+	// so keys can be rotated while serving.
+	keys atomic.Value
+	// Incremented by SetKeys so that callers caching
+	// decryption results know to drop them.
+	generation uint64
 )
 
 func init() {
-	s := os.Getenv("SECRETS")
-	if len(s) > 0 {
-		keys = fernet.MustDecodeKeys(strings.Split(s, ":")...)
+	// Malformed keys are reported when main calls SetKeys.
+	k, _ := fernet.DecodeKeys(strings.Split(os.Getenv("SECRETS"), ":")...)
+	keys.Store(k)
+}
+
+// Replaces the keys used to sign and decrypt credentials.
+// The keys in use are left alone if any secret is malformed.
+func SetKeys(secrets []string) error {
+	k, err := fernet.DecodeKeys(secrets...)
+	if err != nil {
+		return err
 	}
+	keys.Store(k)
+	atomic.AddUint64(&generation, 1)
+	return nil
+}
+
+// Changes whenever the keys are replaced.
+func Generation() uint64 {
+	return atomic.LoadUint64(&generation)
+}
+
+func currentKeys() []*fernet.Key {
+	return keys.Load().([]*fernet.Key)
 }
 
 // Use the first valid key to sign b.
 // Returns error if no key is able to sign b.
 func EncryptAndSign(b []byte) ([]byte, error) {
-	for i := range keys {
-		if res, err := fernet.EncryptAndSign(b, keys[i]); err == nil {
+	k := currentKeys()
+	for i := range k {
+		if res, err := fernet.EncryptAndSign(b, k[i]); err == nil {
 			return res, err
 		}
 	}
@@ -58,14 +85,22 @@ func Parse(authLine string) (string, error) {
 }
 
 func Decrypt(s string) (string, error) {
-	msg := fernet.VerifyAndDecrypt([]byte(s), ttl, keys)
+	msg := fernet.VerifyAndDecrypt([]byte(s), ttl, currentKeys())
 	if msg == nil {
 		return "", errors.New("Unable to decrypt.")
 	}
 	return string(msg), nil
 }
 
-func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Signs the credential in the request body. Documents must
+// name one of backends, usually the names of the outlets.
+func Sign(backends []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sign(backends, w, r)
+	}
+}
+
+func sign(backends []string, w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method must be POST.", 400)
 		return
@@ -77,8 +112,9 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	matched := false
-	for i := range keys {
-		if user == keys[i].Encode() {
+	k := currentKeys()
+	for i := range k {
+		if user == k[i].Encode() {
 			matched = true
 		}
 	}
@@ -92,6 +128,17 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unable to read body.", 400)
 		return
 	}
+	// Documents are checked before they are signed so
+	// that mistakes show up now rather than at send time.
+	c, err := ParseCredential(b)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := c.CheckBackend(backends); err != nil {
+		http.Error(w, "credential: "+err.Error(), 400)
+		return
+	}
 	signed, err := EncryptAndSign(b)
 	if err != nil {
 		http.Error(w, "Unable to sign body.", 500)
@@ -27,6 +27,7 @@ func TestAuth(t *testing.T) {
 }
 
 func testEncryptDecrypt(t *testing.T, ts authTest) {
+	keys := currentKeys()
 	if len(keys) == 0 {
 		t.Fatalf("Must set $SECRETS\n")
 	}
@@ -80,3 +81,43 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestSetKeys(t *testing.T) {
+	old := currentKeys()
+	defer keys.Store(old)
+	if len(old) == 0 {
+		t.Fatalf("Must set $SECRETS\n")
+	}
+	tok, err := EncryptAndSign([]byte("user:password"))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	next := &fernet.Key{}
+	for i := range next {
+		next[i] = byte(i)
+	}
+	g := Generation()
+	// Rotating in a new key while keeping the old one
+	// still decrypts credentials signed with the old key.
+	if err := SetKeys([]string{next.Encode(), old[0].Encode()}); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if _, err := Decrypt(string(tok)); err != nil {
+		t.Errorf("error=%s\n", err)
+	}
+	if err := SetKeys([]string{next.Encode()}); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if _, err := Decrypt(string(tok)); err == nil {
+		t.Errorf("expected decrypt to fail once the old key is dropped\n")
+	}
+	if Generation() != g+2 {
+		t.Errorf("actual=%d expected=%d\n", Generation(), g+2)
+	}
+	if err := SetKeys([]string{"not a key"}); err == nil {
+		t.Errorf("expected error for malformed key\n")
+	}
+	if len(currentKeys()) != 1 {
+		t.Errorf("malformed keys should leave the current keys alone\n")
+	}
+}
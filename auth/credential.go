@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// What a signed credential decrypts to. Credentials are either
+// a JSON document, which routes a drain to one backend, or the
+// bare key used before documents existed, which goes to every
+// enabled outlet:
+//
+//	{"backend": "datadog",
+//	 "endpoint": "https://api.datadoghq.eu/api/v1/series",
+//	 "key": "<api_key>",
+//	 "tags": ["team:web"]}
+type Credential struct {
+	// The outlet the metrics go to. Empty for bare keys.
+	Backend string `json:"backend"`
+	// The URL the outlet posts to instead of its default.
+	Endpoint string `json:"endpoint,omitempty"`
+	// The api key, user:password or token the backend expects.
+	Key string `json:"key"`
+	// Added to every metric sent with the credential.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// The name limits, rules and logs use for the
+// credential: its key without any password.
+func (c *Credential) User() string {
+	return strings.Split(c.Key, ":")[0]
+}
+
+// Reports the first problem with the document.
+func (c *Credential) Validate() error {
+	if len(c.Backend) == 0 {
+		return errors.New("backend is required")
+	}
+	if len(c.Key) == 0 {
+		return errors.New("key is required")
+	}
+	if len(c.Endpoint) > 0 {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New("endpoint must be an http or https URL")
+		}
+	}
+	for _, t := range c.Tags {
+		if len(t) == 0 || strings.ContainsAny(t, ", \t\n") {
+			return fmt.Errorf("tag %q must be non-empty without commas or spaces", t)
+		}
+	}
+	return nil
+}
+
+// Reports whether the document names one of backends. Bare
+// keys name none and go to every backend.
+func (c *Credential) CheckBackend(backends []string) error {
+	if len(c.Backend) == 0 {
+		return nil
+	}
+	for _, b := range backends {
+		if c.Backend == b {
+			return nil
+		}
+	}
+	return fmt.Errorf("backend must be one of %s", strings.Join(backends, ", "))
+}
+
+// Reads a decrypted credential. Anything that isn't
+// a JSON object is taken to be a bare key.
+func ParseCredential(b []byte) (*Credential, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return &Credential{Key: string(b)}, nil
+	}
+	c := new(Credential)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("credential: %s", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("credential: %s", err)
+	}
+	return c, nil
+}
+
+func DecryptCredential(s string) (*Credential, error) {
+	plain, err := Decrypt(s)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCredential([]byte(plain))
+}
+
+// Decrypted credentials by their encrypted form. Decrypting is
+// expensive and the same handful of credentials arrive over and
+// over. Failures are not cached, since anyone can send garbage,
+// and the cache is emptied when it reaches cacheSize entries or
+// the keys change. The zero value is ready to use.
+type Cache struct {
+	sync.Mutex
+	entries map[string]*Credential
+	// The key generation the entries were computed with.
+	generation uint64
+}
+
+// The most credentials a Cache holds. A fernet token carries a
+// timestamp and IV, so one credential can be signed into any
+// number of distinct tokens.
+var cacheSize = 10000
+
+func (c *Cache) Get(encrypted string) (*Credential, error) {
+	c.Lock()
+	defer c.Unlock()
+	if g := Generation(); c.entries == nil || c.generation != g {
+		c.entries = make(map[string]*Credential)
+		c.generation = g
+	}
+	if cred, present := c.entries[encrypted]; present {
+		return cred, nil
+	}
+	cred, err := DecryptCredential(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.entries) >= cacheSize {
+		c.entries = make(map[string]*Credential)
+	}
+	c.entries[encrypted] = cred
+	return cred, nil
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kr/fernet"
+)
+
+var credentialTests = []struct {
+	input string
+	key   string
+	err   string
+}{
+	{"user:password", "user:password", ""},
+	{`{"backend": "datadog", "key": "abc", "tags": ["team:web"]}`, "abc", ""},
+	{`{"backend": "datadog", "endpoint": "https://api.datadoghq.eu/api/v1/series", "key": "abc"}`, "abc", ""},
+	{`{"backend": "graphite", "key": "abc"}`, "abc", ""},
+	{`{"key": "abc"}`, "", "backend is required"},
+	{`{"backend": "datadog"}`, "", "key is required"},
+	{`{"backend": "datadog", "endpoint": "api.datadoghq.eu", "key": "abc"}`, "", "endpoint must be"},
+	{`{"backend": "datadog", "key": "abc", "tags": ["a,b"]}`, "", "tag"},
+	{`{"backend": "datadog", "key": "abc", "site": "eu"}`, "", "unknown field"},
+}
+
+func TestParseCredential(t *testing.T) {
+	for _, ts := range credentialTests {
+		c, err := ParseCredential([]byte(ts.input))
+		if len(ts.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), ts.err) {
+				t.Errorf("input=%s actual-err=%v expected-err=%s\n", ts.input, err, ts.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("input=%s error=%s\n", ts.input, err)
+			continue
+		}
+		if c.Key != ts.key {
+			t.Errorf("input=%s actual=%s expected=%s\n", ts.input, c.Key, ts.key)
+		}
+	}
+}
+
+func TestSignValidatesDocuments(t *testing.T) {
+	defer keys.Store(currentKeys())
+	var k fernet.Key
+	if err := SetKeys([]string{k.Encode()}); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	user := base64.URLEncoding.EncodeToString([]byte(k.Encode() + ":"))
+	for _, c := range []struct {
+		body     string
+		expected int
+	}{
+		{"abc123", 200},
+		{`{"backend": "datadog", "key": "abc123"}`, 200},
+		{`{"backend": "datadog", "key": ""}`, 400},
+		{`{"backend": "graphite", "key": "abc123"}`, 400},
+	} {
+		r := httptest.NewRequest("POST", "/sign", strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Basic "+user)
+		w := httptest.NewRecorder()
+		Sign([]string{"datadog"})(w, r)
+		if w.Code != c.expected {
+			t.Errorf("body=%s actual=%d expected=%d\n", c.body, w.Code, c.expected)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		cred, err := DecryptCredential(w.Body.String())
+		if err != nil || cred.Key != "abc123" {
+			t.Errorf("body=%s actual=%v error=%v\n", c.body, cred, err)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	defer keys.Store(currentKeys())
+	defer func(n int) { cacheSize = n }(cacheSize)
+	var k fernet.Key
+	if err := SetKeys([]string{k.Encode()}); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	cacheSize = 2
+	var c Cache
+	for i := 0; i < 10; i++ {
+		if _, err := c.Get(fmt.Sprintf("garbage-%d", i)); err == nil {
+			t.Fatalf("expected error for garbage\n")
+		}
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("failures should not be cached: actual-len=%d\n", len(c.entries))
+	}
+	for i := 0; i < 5; i++ {
+		tok, err := EncryptAndSign([]byte(fmt.Sprintf("user-%d:", i)))
+		if err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+		cred, err := c.Get(string(tok))
+		if err != nil || cred.Key != fmt.Sprintf("user-%d:", i) {
+			t.Fatalf("actual=%v error=%v\n", cred, err)
+		}
+		if len(c.entries) > cacheSize {
+			t.Errorf("actual-len=%d max-len=%d\n", len(c.entries), cacheSize)
+		}
+	}
+}
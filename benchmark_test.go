@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -14,14 +15,16 @@ func BenchmarkReceive(b *testing.B) {
 	b.StopTimer()
 
 	mchan := metchan.New(cfg)
-	mchan.Start()
+	mchan.Start(context.Background())
+	defer mchan.Stop()
 
 	st := store.NewRedisStore(cfg)
 	st.Mchan = mchan
 
 	recv := receiver.NewReceiver(cfg, st)
 	recv.Mchan = mchan
-	recv.Start()
+	recv.Start(context.Background())
+	defer recv.Stop()
 
 	opts := make(map[string][]string)
 	opts["user"] = []string{"u"}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -29,16 +31,37 @@ type Metric struct {
 	Max       *float64
 	Min       *float64
 	Source    string
+	Tags      []string
 	Auth      string
 	Attr      *MetricAttrs
 	IsComplex bool
+	// Upper bound of a histogram bucket. The Val is the
+	// cumulative count of values less than or equal to Le.
+	Le *float64
+	// Every value of a distribution, set instead of Val.
+	Values []float64
 }
 
+// Measurements keep their raw values until they hold more than
+// this many, after which the values are moved into a Sketch.
+// Small buckets stay exact while large ones stay small.
+const SketchThreshold = 128
+
 type Bucket struct {
 	sync.Mutex
-	Id   *Id
+	Id *Id
+	// Values in the order they were added, so Last
+	// is the most recent one.
 	Vals []float64
 	Sum  float64
+	// A sorted copy of Vals, built on first use. Buckets are
+	// shared by outlets, so Vals itself is never reordered.
+	sorted []float64
+	// Distinct values seen by unique buckets.
+	Hll *HLL
+	// Values of large measurement buckets. When set,
+	// Vals is empty and statistics come from the sketch.
+	Sketch *Sketch
 }
 
 func (b *Bucket) Reset() {
@@ -46,13 +69,66 @@ func (b *Bucket) Reset() {
 	defer b.Unlock()
 	b.Sum = 0
 	b.Vals = b.Vals[:0]
+	b.sorted = nil
+	b.Hll = nil
+	b.Sketch = nil
 }
 
 func (b *Bucket) Append(val float64) {
 	b.Lock()
 	defer b.Unlock()
 	b.Sum += val
+	b.sorted = nil
+	if b.Sketch != nil {
+		b.Sketch.Add(val)
+		return
+	}
 	b.Vals = append(b.Vals, val)
+	if len(b.Vals) > SketchThreshold && b.Id != nil && b.Id.Type == "measurement" {
+		b.toSketch()
+	}
+}
+
+// Moves the raw values into a sketch.
+// Must be called with the lock held.
+func (b *Bucket) toSketch() {
+	b.Sketch = NewSketch()
+	for _, v := range b.Vals {
+		b.Sketch.Add(v)
+	}
+	// Keep the backing array around for Reset to reuse.
+	b.Vals = b.Vals[:0]
+}
+
+// Folds a sketch into a measurement bucket.
+func (b *Bucket) MergeSketch(other *Sketch) {
+	b.Lock()
+	defer b.Unlock()
+	if b.Sketch == nil {
+		b.toSketch()
+	}
+	b.Sketch.Merge(other)
+	b.Sum += other.Sum()
+}
+
+// Records a value for a unique bucket.
+func (b *Bucket) AddUnique(val string) {
+	b.Lock()
+	defer b.Unlock()
+	if b.Hll == nil {
+		b.Hll = NewHLL()
+	}
+	b.Hll.Add(val)
+}
+
+// Folds a serialized sketch into a unique bucket.
+func (b *Bucket) MergeHll(other *HLL) {
+	b.Lock()
+	defer b.Unlock()
+	if b.Hll == nil {
+		b.Hll = NewHLL()
+	}
+	b.Hll.Merge(other)
 }
 
 func (b *Bucket) Incr(val float64) {
@@ -67,6 +143,12 @@ func (b *Bucket) Merge(other *Bucket) {
 	for _, v := range other.Vals {
 		b.Append(v)
 	}
+	if other.Hll != nil {
+		b.MergeHll(other.Hll)
+	}
+	if other.Sketch != nil {
+		b.MergeSketch(other.Sketch)
+	}
 }
 
 // Relies on the Emitter to determine which type of
@@ -79,6 +161,10 @@ func (b *Bucket) Metrics() []*Metric {
 		return b.EmitCounters()
 	case "sample":
 		return b.EmitSamples()
+	case "histogram":
+		return b.EmitHistogram()
+	case "unique":
+		return b.EmitUniques()
 	default:
 		panic("Undefined bucket.Id type.")
 	}
@@ -87,14 +173,26 @@ func (b *Bucket) Metrics() []*Metric {
 // The standard emitter. All log data with `measure.foo` will
 // be mapped to the MeasureEmitter.
 func (b *Bucket) EmitMeasurements() []*Metric {
-	metrics := make([]*Metric, 4)
+	percentiles := b.Id.PercentileList()
+	metrics := make([]*Metric, 1, len(percentiles)+1)
 	metrics[0] = b.ComplexMetric()
-	metrics[1] = b.Metric(".median", b.Median())
-	metrics[2] = b.Metric(".perc95", b.Perc95())
-	metrics[3] = b.Metric(".perc99", b.Perc99())
+	for _, p := range percentiles {
+		suffix := "." + PercentileName(p)
+		metrics = append(metrics, b.Metric(suffix, b.Quantile(p/100)))
+	}
 	return metrics
 }
 
+// The name suffix used for a percentile. The 50th percentile
+// is the median; others are perc95, perc99_9, etc.
+func PercentileName(p float64) string {
+	if p == 50 {
+		return "median"
+	}
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	return "perc" + strings.Replace(s, ".", "_", -1)
+}
+
 func (b *Bucket) EmitCounters() []*Metric {
 	metrics := make([]*Metric, 1)
 	metrics[0] = b.Metric("", b.Sum)
@@ -107,6 +205,47 @@ func (b *Bucket) EmitSamples() []*Metric {
 	return metrics
 }
 
+// Emits the estimated number of distinct values as a single gauge.
+func (b *Bucket) EmitUniques() []*Metric {
+	metrics := make([]*Metric, 1)
+	metrics[0] = b.Metric("", float64(b.Unique()))
+	return metrics
+}
+
+// Emits one metric per histogram boundary (plus +Inf) holding the
+// cumulative count of values at or below the boundary, followed by
+// the count and sum of all values.
+func (b *Bucket) EmitHistogram() []*Metric {
+	counts := b.Cumulative()
+	bounds := append(b.Id.BoundList(), math.Inf(1))
+	metrics := make([]*Metric, 0, len(bounds)+2)
+	for i := range bounds {
+		m := b.Metric("", float64(counts[i]))
+		m.Le = &bounds[i]
+		metrics = append(metrics, m)
+	}
+	metrics = append(metrics, b.Metric(".count", float64(b.Count())))
+	metrics = append(metrics, b.Metric(".sum", b.Sum))
+	return metrics
+}
+
+// Returns the cumulative number of values at or below each of
+// the histogram bounds. The last element counts all values.
+func (b *Bucket) Cumulative() []int {
+	bounds := b.Id.BoundList()
+	counts := make([]int, len(bounds)+1)
+	vals := b.sortedVals()
+	j := 0
+	for i, bound := range bounds {
+		for j < len(vals) && vals[j] <= bound {
+			j++
+		}
+		counts[i] = j
+	}
+	counts[len(bounds)] = len(vals)
+	return counts
+}
+
 func (b *Bucket) ComplexMetric() *Metric {
 	min := b.Min()
 	max := b.Max()
@@ -119,6 +258,7 @@ func (b *Bucket) ComplexMetric() *Metric {
 		},
 		Name:      b.Id.Name,
 		Source:    b.Id.Source,
+		Tags:      b.Id.TagList(),
 		Time:      b.Id.Time.Unix(),
 		Auth:      b.Id.Auth,
 		Min:       &min,
@@ -129,6 +269,20 @@ func (b *Bucket) ComplexMetric() *Metric {
 	}
 }
 
+// Emits a single metric holding the values of a measurement
+// bucket, for backends that compute percentiles themselves.
+// Sketches are approximated by roughly max values.
+func (b *Bucket) DistributionMetric(max int) *Metric {
+	m := b.Metric("", 0)
+	m.Val = nil
+	if b.Sketch != nil {
+		m.Values = b.Sketch.Values(max)
+	} else {
+		m.Values = b.Vals
+	}
+	return m
+}
+
 // If an non-empty suffix is given, the name of the resulting Metric
 // will contain the suffix.
 func (b *Bucket) Metric(suffix string, val float64) *Metric {
@@ -139,6 +293,7 @@ func (b *Bucket) Metric(suffix string, val float64) *Metric {
 		},
 		Name:   b.Id.Name + suffix,
 		Source: b.Id.Source,
+		Tags:   b.Id.TagList(),
 		Time:   b.Id.Time.Unix(),
 		Auth:   b.Id.Auth,
 		Val:    &val,
@@ -146,11 +301,26 @@ func (b *Bucket) Metric(suffix string, val float64) *Metric {
 }
 
 func (b *Bucket) String() string {
+	if b.Sketch != nil {
+		return fmt.Sprintf("name=%s source=%s count=%d",
+			b.Id.Name, b.Id.Source, b.Sketch.Count())
+	}
 	return fmt.Sprintf("name=%s source=%s vals=%v",
 		b.Id.Name, b.Id.Source, b.Vals)
 }
 
+// The estimated number of distinct values in a unique bucket.
+func (b *Bucket) Unique() uint64 {
+	if b.Hll == nil {
+		return 0
+	}
+	return b.Hll.Count()
+}
+
 func (b *Bucket) Count() int {
+	if b.Sketch != nil {
+		return b.Sketch.Count()
+	}
 	return len(b.Vals)
 }
 
@@ -167,54 +337,64 @@ func (b *Bucket) Sort() {
 	}
 }
 
+// Returns the values in increasing order without
+// reordering Vals. The result must not be modified.
+func (b *Bucket) sortedVals() []float64 {
+	b.Lock()
+	defer b.Unlock()
+	if b.sorted == nil || len(b.sorted) != len(b.Vals) {
+		b.sorted = append([]float64(nil), b.Vals...)
+		sort.Float64s(b.sorted)
+	}
+	return b.sorted
+}
+
 func (b *Bucket) Min() float64 {
 	if b.Count() == 0 {
 		return float64(0)
 	}
-	b.Sort()
-	return b.Vals[0]
+	if b.Sketch != nil {
+		return b.Sketch.Min()
+	}
+	return b.sortedVals()[0]
 }
 
-func (b *Bucket) Median() float64 {
-	if b.Count() == 0 {
-		return float64(0)
+// Returns the value at quantile q (0 <= q <= 1)
+// using DefaultQuantileMethod.
+func (b *Bucket) Quantile(q float64) float64 {
+	if b.Sketch != nil {
+		return b.Sketch.Quantile(q)
 	}
-	b.Sort()
-	pos := int(math.Ceil(float64(b.Count() / 2)))
-	return b.Vals[pos]
+	return Quantile(b.sortedVals(), q, DefaultQuantileMethod)
+}
+
+func (b *Bucket) Median() float64 {
+	return b.Quantile(0.5)
 }
 
 func (b *Bucket) Perc95() float64 {
-	if b.Count() == 0 {
-		return float64(0)
-	}
-	b.Sort()
-	pos := int(math.Floor(float64(b.Count()) * 0.95))
-	return b.Vals[pos]
+	return b.Quantile(0.95)
 }
 
 func (b *Bucket) Perc99() float64 {
-	if b.Count() == 0 {
-		return float64(0)
-	}
-	b.Sort()
-	pos := int(math.Floor(float64(b.Count()) * 0.99))
-	return b.Vals[pos]
+	return b.Quantile(0.99)
 }
 
 func (b *Bucket) Max() float64 {
 	if b.Count() == 0 {
 		return float64(0)
 	}
-	b.Sort()
-	pos := b.Count() - 1
-	return b.Vals[pos]
+	if b.Sketch != nil {
+		return b.Sketch.Max()
+	}
+	vals := b.sortedVals()
+	return vals[len(vals)-1]
 }
 
 func (b *Bucket) Last() float64 {
-	if b.Count() == 0 {
+	if len(b.Vals) == 0 {
 		return float64(0)
 	}
-	pos := b.Count() - 1
+	pos := len(b.Vals) - 1
 	return b.Vals[pos]
 }
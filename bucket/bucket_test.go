@@ -0,0 +1,94 @@
+package bucket
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEmitHistogram(t *testing.T) {
+	b := &Bucket{Id: &Id{Name: "latency", Type: "histogram", Bounds: "10,100"}}
+	for _, v := range []float64{5, 10, 50, 500} {
+		b.Append(v)
+	}
+	expected := []struct {
+		name string
+		le   float64
+		val  float64
+	}{
+		{"latency", 10, 2},
+		{"latency", 100, 3},
+		{"latency", math.Inf(1), 4},
+		{"latency.count", 0, 4},
+		{"latency.sum", 0, 565},
+	}
+	metrics := b.Metrics()
+	if len(metrics) != len(expected) {
+		t.Fatalf("actual-len=%d expected-len=%d\n", len(metrics), len(expected))
+	}
+	for i, e := range expected {
+		m := metrics[i]
+		if m.Name != e.name || *m.Val != e.val {
+			t.Errorf("actual=%s:%f expected=%s:%f\n", m.Name, *m.Val, e.name, e.val)
+		}
+		if e.le != 0 && (m.Le == nil || *m.Le != e.le) {
+			t.Errorf("name=%s actual-le=%v expected-le=%f\n", m.Name, m.Le, e.le)
+		}
+	}
+}
+
+func TestEmitSamplesKeepsLastValue(t *testing.T) {
+	b := &Bucket{Id: &Id{Name: "load", Type: "sample"}}
+	for _, v := range []float64{3, 5, 1, 2} {
+		b.Append(v)
+	}
+	// Order statistics must not reorder the values.
+	if b.Max() != 5 || b.Min() != 1 || b.Quantile(0.5) != 2 {
+		t.Errorf("actual=%f,%f,%f expected=5,1,2\n", b.Max(), b.Min(), b.Quantile(0.5))
+	}
+	if actual := *b.Metrics()[0].Val; actual != 2 {
+		t.Errorf("actual=%f expected=2\n", actual)
+	}
+}
+
+func TestParseBounds(t *testing.T) {
+	bounds, err := ParseBounds("100,1,10,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := FormatBounds(bounds); actual != "1,10,100" {
+		t.Errorf("actual=%s expected=1,10,100\n", actual)
+	}
+	if _, err := ParseBounds("1,x"); err == nil {
+		t.Errorf("expected error for malformed bound\n")
+	}
+}
+
+func TestEmitMeasurementsPercentiles(t *testing.T) {
+	for _, tc := range []struct {
+		percentiles string
+		names       []string
+	}{
+		{"", []string{"a", "a.median", "a.perc95", "a.perc99"}},
+		{"75,99.9", []string{"a", "a.perc75", "a.perc99_9"}},
+	} {
+		b := &Bucket{Id: &Id{Name: "a", Type: "measurement", Percentiles: tc.percentiles}}
+		b.Append(1)
+		metrics := b.Metrics()
+		if len(metrics) != len(tc.names) {
+			t.Fatalf("actual-len=%d expected-len=%d\n", len(metrics), len(tc.names))
+		}
+		for i := range tc.names {
+			if metrics[i].Name != tc.names[i] {
+				t.Errorf("actual=%s expected=%s\n", metrics[i].Name, tc.names[i])
+			}
+		}
+	}
+}
+
+func TestParsePercentiles(t *testing.T) {
+	for _, s := range []string{"0", "101", "50,x"} {
+		if _, err := ParsePercentiles(s); err == nil {
+			t.Errorf("input=%s expected error\n", s)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package bucket
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// 2^14 registers gives a standard error of about 0.8%.
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	// Sketches stay sparse until they hold this many registers.
+	// Most buckets see a handful of values, so this keeps the
+	// per-log-line buckets built by the parser small.
+	hllSparseMax = hllRegisters / 8
+	hllVersion   = 1
+)
+
+// A HyperLogLog sketch for estimating the number of distinct
+// values. Registers are kept in a map until the sketch becomes
+// dense enough for a flat array to be cheaper.
+type HLL struct {
+	sparse map[uint16]uint8
+	dense  []uint8
+}
+
+func NewHLL() *HLL {
+	return &HLL{sparse: make(map[uint16]uint8)}
+}
+
+func (h *HLL) Add(val string) {
+	f := fnv.New64a()
+	f.Write([]byte(val))
+	x := mix64(f.Sum64())
+	idx := uint16(x >> (64 - hllPrecision))
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	h.set(idx, rank)
+}
+
+func (h *HLL) set(idx uint16, rank uint8) {
+	if h.dense != nil {
+		if rank > h.dense[idx] {
+			h.dense[idx] = rank
+		}
+		return
+	}
+	if rank > h.sparse[idx] {
+		h.sparse[idx] = rank
+	}
+	if len(h.sparse) > hllSparseMax {
+		h.dense = make([]uint8, hllRegisters)
+		for i, r := range h.sparse {
+			h.dense[i] = r
+		}
+		h.sparse = nil
+	}
+}
+
+// Folds other into h. Afterwards h estimates the
+// number of distinct values added to either sketch.
+func (h *HLL) Merge(other *HLL) {
+	if other.dense != nil {
+		for i, r := range other.dense {
+			if r > 0 {
+				h.set(uint16(i), r)
+			}
+		}
+		return
+	}
+	for i, r := range other.sparse {
+		h.set(i, r)
+	}
+}
+
+// Estimates the number of distinct values.
+func (h *HLL) Count() uint64 {
+	m := float64(hllRegisters)
+	sum := float64(0)
+	zeros := 0
+	if h.dense != nil {
+		for _, r := range h.dense {
+			sum += 1 / float64(uint64(1)<<r)
+			if r == 0 {
+				zeros++
+			}
+		}
+	} else {
+		zeros = hllRegisters - len(h.sparse)
+		sum = float64(zeros)
+		for _, r := range h.sparse {
+			sum += 1 / float64(uint64(1)<<r)
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	est := alpha * m * m / sum
+	// Linear counting is more accurate for small cardinalities.
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// Binary format:
+//
+//	version, mode (0 sparse, 1 dense), then either
+//	uvarint count followed by (uint16 idx, uint8 rank) pairs
+//	or the dense registers.
+func (h *HLL) MarshalBinary() ([]byte, error) {
+	if h.dense != nil {
+		b := make([]byte, 2, 2+hllRegisters)
+		b[0], b[1] = hllVersion, 1
+		return append(b, h.dense...), nil
+	}
+	b := make([]byte, 2+binary.MaxVarintLen64, 2+binary.MaxVarintLen64+3*len(h.sparse))
+	b[0], b[1] = hllVersion, 0
+	b = b[:2+binary.PutUvarint(b[2:], uint64(len(h.sparse)))]
+	for i, r := range h.sparse {
+		b = append(b, byte(i>>8), byte(i), r)
+	}
+	return b, nil
+}
+
+func (h *HLL) UnmarshalBinary(b []byte) error {
+	errHLL := errors.New("bucket: malformed hll")
+	if len(b) < 2 || b[0] != hllVersion {
+		return errHLL
+	}
+	switch b[1] {
+	case 1:
+		if len(b) != 2+hllRegisters {
+			return errHLL
+		}
+		h.sparse = nil
+		h.dense = append([]uint8(nil), b[2:]...)
+	case 0:
+		n, k := binary.Uvarint(b[2:])
+		if k <= 0 || uint64(len(b)-2-k) != 3*n {
+			return errHLL
+		}
+		h.dense = nil
+		h.sparse = make(map[uint16]uint8, n)
+		for p := 2 + k; p < len(b); p += 3 {
+			h.set(uint16(b[p])<<8|uint16(b[p+1]), b[p+2])
+		}
+	default:
+		return errHLL
+	}
+	return nil
+}
+
+// Finalizer from MurmurHash3. FNV leaves the high bits
+// poorly mixed for short inputs, which HLL depends on.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
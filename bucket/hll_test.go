@@ -0,0 +1,56 @@
+package bucket
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHLLCount(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 10000, 100000} {
+		h := NewHLL()
+		for i := 0; i < n; i++ {
+			h.Add("user_" + strconv.Itoa(i))
+			// Duplicates must not change the estimate.
+			h.Add("user_" + strconv.Itoa(i))
+		}
+		actual := float64(h.Count())
+		if math.Abs(actual-float64(n)) > float64(n)*0.03 {
+			t.Errorf("actual=%f expected=%d\n", actual, n)
+		}
+	}
+}
+
+func TestHLLMergeAndMarshal(t *testing.T) {
+	for _, n := range []int{10, 50000} {
+		a, b := NewHLL(), NewHLL()
+		for i := 0; i < n; i++ {
+			a.Add("a" + strconv.Itoa(i))
+			b.Add("b" + strconv.Itoa(i))
+		}
+		raw, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := new(HLL)
+		if err := c.UnmarshalBinary(raw); err != nil {
+			t.Fatal(err)
+		}
+		if c.Count() != b.Count() {
+			t.Errorf("actual=%d expected=%d\n", c.Count(), b.Count())
+		}
+		a.Merge(c)
+		actual := float64(a.Count())
+		if math.Abs(actual-float64(2*n)) > float64(2*n)*0.03 {
+			t.Errorf("actual=%f expected=%d\n", actual, 2*n)
+		}
+	}
+}
+
+func TestHLLUnmarshalMalformed(t *testing.T) {
+	for _, b := range [][]byte{nil, {hllVersion}, {hllVersion, 0, 5, 1}, {hllVersion, 1, 0}, {9, 0, 0}} {
+		if err := new(HLL).UnmarshalBinary(b); err == nil {
+			t.Errorf("input=%v expected error\n", b)
+		}
+	}
+}
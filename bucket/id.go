@@ -3,7 +3,11 @@ package bucket
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"hash/crc64"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,8 +22,21 @@ type Id struct {
 	Units      string
 	Source     string
 	Type       string
+	// Comma separated list of key:value tags. Kept as a
+	// string so that the Id can be used as a map key.
+	Tags string
+	// Comma separated, sorted upper bounds of histogram buckets.
+	// Only set for histograms.
+	Bounds string
+	// Comma separated, sorted percentiles (0-100] to emit.
+	// Only set for measurements.
+	Percentiles string
 }
 
+// Percentiles emitted for measurements whose Id
+// doesn't specify any.
+const DefaultPercentiles = "50,95,99"
+
 func (id *Id) Partition(max uint64) uint64 {
 	b, err := id.Encode()
 	if err != nil {
@@ -28,6 +45,81 @@ func (id *Id) Partition(max uint64) uint64 {
 	return crc64.Checksum(b, partitionTable) % max
 }
 
+// Returns the tags as a slice of key:value strings.
+func (id *Id) TagList() []string {
+	if len(id.Tags) == 0 {
+		return nil
+	}
+	return strings.Split(id.Tags, ",")
+}
+
+// Returns the histogram bucket boundaries. Malformed
+// boundaries are skipped.
+func (id *Id) BoundList() []float64 {
+	bounds, _ := ParseBounds(id.Bounds)
+	return bounds
+}
+
+// Returns the percentiles to emit, falling back to
+// DefaultPercentiles when none are set.
+func (id *Id) PercentileList() []float64 {
+	if len(id.Percentiles) > 0 {
+		if p, err := ParsePercentiles(id.Percentiles); err == nil && len(p) > 0 {
+			return p
+		}
+	}
+	p, _ := ParsePercentiles(DefaultPercentiles)
+	return p
+}
+
+// Parses a comma separated list of percentiles. Each must
+// be greater than 0 and no greater than 100.
+func ParsePercentiles(s string) ([]float64, error) {
+	p, err := ParseBounds(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) > 0 && (p[0] <= 0 || p[len(p)-1] > 100) {
+		return nil, errors.New("bucket: percentiles must be in (0, 100]")
+	}
+	return p, nil
+}
+
+// Parses a comma separated list of histogram boundaries.
+// The result is sorted and de-duplicated.
+func ParseBounds(s string) ([]float64, error) {
+	var bounds []float64
+	var err error
+	for _, f := range strings.Split(s, ",") {
+		if len(f) == 0 {
+			continue
+		}
+		v, perr := strconv.ParseFloat(f, 64)
+		if perr != nil {
+			err = errors.New("bucket: invalid histogram bound " + f)
+			continue
+		}
+		bounds = append(bounds, v)
+	}
+	sort.Float64s(bounds)
+	uniq := bounds[:0]
+	for i, v := range bounds {
+		if i == 0 || v != uniq[len(uniq)-1] {
+			uniq = append(uniq, v)
+		}
+	}
+	return uniq, err
+}
+
+// Formats bounds in the form stored in Id.Bounds.
+func FormatBounds(bounds []float64) string {
+	s := make([]string, len(bounds))
+	for i, v := range bounds {
+		s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
 func (id *Id) Decode(b *bytes.Buffer) error {
 	dec := gob.NewDecoder(b)
 	return dec.Decode(id)
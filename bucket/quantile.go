@@ -0,0 +1,75 @@
+package bucket
+
+import (
+	"errors"
+	"math"
+)
+
+// How a quantile is computed from a sorted set of values.
+type QuantileMethod int
+
+const (
+	// The smallest value such that at least q of the values
+	// are less than or equal to it. Always an observed value.
+	NearestRank QuantileMethod = iota
+	// Linear interpolation between the two closest ranks, the
+	// same as R's type 7 and numpy's default. Gives smoother
+	// results for small buckets.
+	Linear
+)
+
+// The method used by Bucket.Quantile. Sketched buckets
+// always use the nearest rank over their bins.
+var DefaultQuantileMethod = NearestRank
+
+func ParseQuantileMethod(s string) (QuantileMethod, error) {
+	switch s {
+	case "nearest", "nearest-rank":
+		return NearestRank, nil
+	case "linear":
+		return Linear, nil
+	}
+	return 0, errors.New("bucket: unknown quantile method " + s)
+}
+
+func (m QuantileMethod) String() string {
+	if m == Linear {
+		return "linear"
+	}
+	return "nearest"
+}
+
+// Returns the value at quantile q (0 <= q <= 1) of vals,
+// which must be sorted in increasing order.
+func Quantile(vals []float64, q float64, m QuantileMethod) float64 {
+	n := len(vals)
+	if n == 0 {
+		return 0
+	}
+	q = math.Max(0, math.Min(1, q))
+	if m == Linear {
+		h := q * float64(n-1)
+		lo := math.Floor(h)
+		i := int(lo)
+		if i >= n-1 {
+			return vals[n-1]
+		}
+		return vals[i] + (h-lo)*(vals[i+1]-vals[i])
+	}
+	return vals[nearestRank(q, n)]
+}
+
+// The zero-based index of the nearest rank for q in n values.
+// q*n is nudged down before rounding up so that a product
+// that should be whole but carries float error, like
+// 0.55*100 = 55.00000000000001, keeps its exact rank.
+func nearestRank(q float64, n int) int {
+	i := int(math.Ceil(q*float64(n)*(1-1e-12))) - 1
+	if i < 0 {
+		return 0
+	}
+	if i > n-1 {
+		return n - 1
+	}
+	return i
+}
@@ -0,0 +1,96 @@
+package bucket
+
+import (
+	"math"
+	"testing"
+)
+
+var quantileTests = []struct {
+	vals    []float64
+	q       float64
+	nearest float64
+	linear  float64
+}{
+	{[]float64{42}, 0.5, 42, 42},
+	{[]float64{42}, 0.99, 42, 42},
+	{[]float64{1, 2}, 0.5, 1, 1.5},
+	{[]float64{1, 2, 3, 4}, 0.5, 2, 2.5},
+	{[]float64{1, 2, 3, 4}, 0.95, 4, 3.85},
+	// Reference values from the nearest-rank examples on Wikipedia
+	// and from numpy.percentile with the default interpolation.
+	{[]float64{15, 20, 35, 40, 50}, 0.05, 15, 16},
+	{[]float64{15, 20, 35, 40, 50}, 0.3, 20, 23},
+	{[]float64{15, 20, 35, 40, 50}, 0.4, 20, 29},
+	{[]float64{15, 20, 35, 40, 50}, 0.5, 35, 35},
+	{[]float64{15, 20, 35, 40, 50}, 1, 50, 50},
+	{[]float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 0.25, 7, 7.25},
+	{[]float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 0.5, 8, 9},
+	{[]float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 0.75, 15, 14.5},
+	{[]float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 0.99, 20, 19.64},
+	{[]float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 0, 3, 3},
+	// q*n is not a whole number in floating point for these.
+	{oneToHundred(), 0.07, 7, 7.93},
+	{oneToHundred(), 0.55, 55, 55.45},
+	{oneToHundred(), 0.29, 29, 29.71},
+}
+
+func oneToHundred() []float64 {
+	vals := make([]float64, 100)
+	for i := range vals {
+		vals[i] = float64(i + 1)
+	}
+	return vals
+}
+
+func TestQuantile(t *testing.T) {
+	for _, tc := range quantileTests {
+		for m, expected := range map[QuantileMethod]float64{
+			NearestRank: tc.nearest,
+			Linear:      tc.linear,
+		} {
+			actual := Quantile(tc.vals, tc.q, m)
+			if math.Abs(actual-expected) > 1e-9 {
+				t.Errorf("vals=%v q=%g method=%s actual=%g expected=%g\n",
+					tc.vals, tc.q, m, actual, expected)
+			}
+		}
+	}
+}
+
+func TestQuantileEmpty(t *testing.T) {
+	if actual := Quantile(nil, 0.5, Linear); actual != 0 {
+		t.Errorf("actual=%g expected=0\n", actual)
+	}
+}
+
+func TestBucketQuantile(t *testing.T) {
+	defer func(m QuantileMethod) { DefaultQuantileMethod = m }(DefaultQuantileMethod)
+	b := &Bucket{Id: &Id{Name: "a", Type: "measurement"}}
+	for _, v := range []float64{4, 3, 2, 1} {
+		b.Append(v)
+	}
+	DefaultQuantileMethod = NearestRank
+	if actual := b.Median(); actual != 2 {
+		t.Errorf("method=nearest actual=%g expected=2\n", actual)
+	}
+	DefaultQuantileMethod = Linear
+	if actual := b.Median(); actual != 2.5 {
+		t.Errorf("method=linear actual=%g expected=2.5\n", actual)
+	}
+}
+
+func TestParseQuantileMethod(t *testing.T) {
+	for s, expected := range map[string]QuantileMethod{
+		"nearest":      NearestRank,
+		"nearest-rank": NearestRank,
+		"linear":       Linear,
+	} {
+		actual, err := ParseQuantileMethod(s)
+		if err != nil || actual != expected {
+			t.Errorf("input=%s actual=%s expected=%s err=%v\n", s, actual, expected, err)
+		}
+	}
+	if _, err := ParseQuantileMethod("median"); err == nil {
+		t.Errorf("expected error for unknown method\n")
+	}
+}
@@ -0,0 +1,280 @@
+package bucket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	// Quantiles are within 1% of the true value.
+	sketchAccuracy = 0.01
+	// Upper bound on the number of bins. With 1% accuracy this
+	// covers values from 1µs to over 10^8 before collapsing.
+	sketchMaxBins = 2048
+	// Values closer to zero than this are counted as zero.
+	sketchMinValue = 1e-9
+	sketchMagic    = 'D'
+	sketchVersion  = 1
+)
+
+var sketchGamma = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+var sketchLogGamma = math.Log(sketchGamma)
+
+// A mergeable quantile sketch with bounded relative error,
+// following DDSketch. Values are counted in logarithmically
+// sized bins, so the size depends on the range of the values
+// and not on how many were added. Count, sum, min and max are
+// tracked exactly.
+type Sketch struct {
+	pos   map[int32]uint64
+	neg   map[int32]uint64
+	zero  uint64
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func NewSketch() *Sketch {
+	return &Sketch{
+		pos: make(map[int32]uint64),
+		neg: make(map[int32]uint64),
+	}
+}
+
+func sketchIndex(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// The value that represents everything in bin i. It is within
+// sketchAccuracy of every value that maps to the bin.
+func sketchValue(i int32) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+}
+
+func (s *Sketch) Add(v float64) {
+	s.addN(v, 1)
+}
+
+func (s *Sketch) addN(v float64, n uint64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count += n
+	s.sum += v * float64(n)
+	switch {
+	case v > sketchMinValue:
+		s.pos[sketchIndex(v)] += n
+	case v < -sketchMinValue:
+		s.neg[sketchIndex(-v)] += n
+	default:
+		s.zero += n
+	}
+	s.collapse()
+}
+
+func (s *Sketch) Merge(other *Sketch) {
+	if other.count == 0 {
+		return
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.zero += other.zero
+	for i, n := range other.pos {
+		s.pos[i] += n
+	}
+	for i, n := range other.neg {
+		s.neg[i] += n
+	}
+	s.collapse()
+}
+
+// Keeps the number of bins bounded by folding the bins closest
+// to zero together. This sacrifices accuracy for the smallest
+// magnitudes, which rarely matter for latency-style data.
+func (s *Sketch) collapse() {
+	for len(s.pos)+len(s.neg) > sketchMaxBins {
+		bins := s.pos
+		if len(s.neg) > len(s.pos) {
+			bins = s.neg
+		}
+		keys := sortedBins(bins)
+		bins[keys[1]] += bins[keys[0]]
+		delete(bins, keys[0])
+	}
+}
+
+func sortedBins(bins map[int32]uint64) []int32 {
+	keys := make([]int32, 0, len(bins))
+	for i := range bins {
+		keys = append(keys, i)
+	}
+	sort.Sort(int32s(keys))
+	return keys
+}
+
+type int32s []int32
+
+func (a int32s) Len() int           { return len(a) }
+func (a int32s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int32s) Less(i, j int) bool { return a[i] < a[j] }
+
+func (s *Sketch) Count() int   { return int(s.count) }
+func (s *Sketch) Sum() float64 { return s.sum }
+func (s *Sketch) Min() float64 { return s.min }
+func (s *Sketch) Max() float64 { return s.max }
+
+// Approximates the values added to the sketch by the middle of
+// their bins, in ascending order. The smallest and largest are
+// the exact min and max. When the sketch holds more than max
+// values, every bin is scaled down so that max are returned.
+func (s *Sketch) Values(max int) []float64 {
+	scale := float64(1)
+	if max > 0 && s.count > uint64(max) {
+		scale = float64(max) / float64(s.count)
+	}
+	var vals []float64
+	// Carries the fractions of values left over from
+	// scaling so that small bins aren't all lost.
+	var carry float64
+	add := func(v float64, n uint64) {
+		carry += float64(n) * scale
+		for ; carry >= 1; carry-- {
+			vals = append(vals, s.clamp(v))
+		}
+	}
+	neg := sortedBins(s.neg)
+	for i := len(neg) - 1; i >= 0; i-- {
+		add(-sketchValue(neg[i]), s.neg[neg[i]])
+	}
+	add(0, s.zero)
+	for _, i := range sortedBins(s.pos) {
+		add(sketchValue(i), s.pos[i])
+	}
+	if len(vals) > 0 {
+		vals[0] = s.min
+		vals[len(vals)-1] = s.max
+	}
+	return vals
+}
+
+// Returns the value at quantile q (0 <= q <= 1) using the
+// nearest rank over the bins.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(nearestRank(q, int(s.count)))
+	var cum uint64
+	neg := sortedBins(s.neg)
+	for i := len(neg) - 1; i >= 0; i-- {
+		cum += s.neg[neg[i]]
+		if cum > rank {
+			return s.clamp(-sketchValue(neg[i]))
+		}
+	}
+	cum += s.zero
+	if cum > rank {
+		return s.clamp(0)
+	}
+	for _, i := range sortedBins(s.pos) {
+		cum += s.pos[i]
+		if cum > rank {
+			return s.clamp(sketchValue(i))
+		}
+	}
+	return s.max
+}
+
+func (s *Sketch) clamp(v float64) float64 {
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// Binary format: magic, version, uvarint count, float64 sum,
+// min & max, uvarint zero count, then the positive and negative
+// bins, each as a uvarint length followed by (varint index,
+// uvarint count) pairs.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(sketchMagic)
+	buf.WriteByte(sketchVersion)
+	putUvarint(&buf, s.count)
+	for _, f := range []float64{s.sum, s.min, s.max} {
+		binary.Write(&buf, binary.LittleEndian, f)
+	}
+	putUvarint(&buf, s.zero)
+	for _, bins := range []map[int32]uint64{s.pos, s.neg} {
+		putUvarint(&buf, uint64(len(bins)))
+		for i, n := range bins {
+			var tmp [binary.MaxVarintLen64]byte
+			buf.Write(tmp[:binary.PutVarint(tmp[:], int64(i))])
+			putUvarint(&buf, n)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	errSketch := errors.New("bucket: malformed sketch")
+	if !IsSketch(b) {
+		return errSketch
+	}
+	r := bytes.NewReader(b[2:])
+	var err error
+	tmp := NewSketch()
+	if tmp.count, err = binary.ReadUvarint(r); err != nil {
+		return errSketch
+	}
+	for _, f := range []*float64{&tmp.sum, &tmp.min, &tmp.max} {
+		if err := binary.Read(r, binary.LittleEndian, f); err != nil {
+			return errSketch
+		}
+	}
+	if tmp.zero, err = binary.ReadUvarint(r); err != nil {
+		return errSketch
+	}
+	for _, bins := range []map[int32]uint64{tmp.pos, tmp.neg} {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return errSketch
+		}
+		for j := uint64(0); j < n; j++ {
+			i, err := binary.ReadVarint(r)
+			if err != nil {
+				return errSketch
+			}
+			c, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errSketch
+			}
+			bins[int32(i)] += c
+		}
+	}
+	if r.Len() != 0 {
+		return errSketch
+	}
+	*s = *tmp
+	return nil
+}
+
+// Reports whether b looks like a serialized Sketch.
+func IsSketch(b []byte) bool {
+	return len(b) >= 2 && b[0] == sketchMagic && b[1] == sketchVersion
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
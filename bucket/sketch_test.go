@@ -0,0 +1,138 @@
+package bucket
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func exactQuantile(vals []float64, q float64) float64 {
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+	return Quantile(sorted, q, NearestRank)
+}
+
+func TestSketchAccuracy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	dists := map[string]func() float64{
+		"uniform":     func() float64 { return r.Float64() * 1000 },
+		"exponential": func() float64 { return r.ExpFloat64() * 50 },
+		"lognormal":   func() float64 { return math.Exp(r.NormFloat64() * 2) },
+		"mixed-sign":  func() float64 { return r.NormFloat64() * 100 },
+	}
+	for name, f := range dists {
+		s := NewSketch()
+		vals := make([]float64, 10000)
+		for i := range vals {
+			vals[i] = f()
+			s.Add(vals[i])
+		}
+		for _, q := range []float64{0, 0.5, 0.95, 0.99, 1} {
+			expected := exactQuantile(vals, q)
+			actual := s.Quantile(q)
+			if math.Abs(actual-expected) > math.Abs(expected)*sketchAccuracy+1e-9 {
+				t.Errorf("dist=%s q=%f actual=%f expected=%f\n", name, q, actual, expected)
+			}
+		}
+	}
+}
+
+func TestSketchMergeAndMarshal(t *testing.T) {
+	a, b := NewSketch(), NewSketch()
+	var vals []float64
+	for i := 1; i <= 1000; i++ {
+		a.Add(float64(i))
+		b.Add(float64(-i))
+		vals = append(vals, float64(i), float64(-i))
+	}
+	b.Add(0)
+	vals = append(vals, 0)
+	raw, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewSketch()
+	if err := c.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	a.Merge(c)
+	if a.Count() != len(vals) || a.Sum() != 0 || a.Min() != -1000 || a.Max() != 1000 {
+		t.Fatalf("count=%d sum=%f min=%f max=%f\n", a.Count(), a.Sum(), a.Min(), a.Max())
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		expected := exactQuantile(vals, q)
+		actual := a.Quantile(q)
+		if math.Abs(actual-expected) > math.Abs(expected)*sketchAccuracy+1e-9 {
+			t.Errorf("q=%f actual=%f expected=%f\n", q, actual, expected)
+		}
+	}
+	if err := c.UnmarshalBinary(raw[:len(raw)-1]); err == nil {
+		t.Errorf("expected error for truncated sketch\n")
+	}
+}
+
+func TestSketchBoundedBins(t *testing.T) {
+	s := NewSketch()
+	for v := 1e-6; v < 1e12; v *= 1.001 {
+		s.Add(v)
+	}
+	if n := len(s.pos) + len(s.neg); n > sketchMaxBins {
+		t.Errorf("actual-bins=%d max-bins=%d\n", n, sketchMaxBins)
+	}
+}
+
+func TestBucketSwitchesToSketch(t *testing.T) {
+	b := &Bucket{Id: &Id{Type: "measurement"}}
+	other := &Bucket{Id: &Id{Type: "measurement"}}
+	for i := 1; i <= SketchThreshold; i++ {
+		b.Append(float64(i))
+		other.Append(float64(i))
+	}
+	if b.Sketch != nil {
+		t.Fatalf("expected raw values below the threshold\n")
+	}
+	b.Merge(other)
+	if b.Sketch == nil || len(b.Vals) != 0 {
+		t.Fatalf("expected sketch above the threshold\n")
+	}
+	if b.Count() != 2*SketchThreshold || b.Sum != float64(SketchThreshold*(SketchThreshold+1)) {
+		t.Errorf("actual-count=%d actual-sum=%f\n", b.Count(), b.Sum)
+	}
+	if b.Min() != 1 || b.Max() != SketchThreshold {
+		t.Errorf("actual-min=%f actual-max=%f\n", b.Min(), b.Max())
+	}
+}
+
+func TestSketchValues(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	s := NewSketch()
+	vals := make([]float64, 10000)
+	for i := range vals {
+		vals[i] = r.NormFloat64() * 100
+		s.Add(vals[i])
+	}
+	for _, max := range []int{0, 1000} {
+		approx := s.Values(max)
+		if max == 0 && len(approx) != len(vals) {
+			t.Errorf("max=0 actual-len=%d expected-len=%d\n", len(approx), len(vals))
+		}
+		if max > 0 && (len(approx) < max-1 || len(approx) > max) {
+			t.Errorf("max=%d actual-len=%d\n", max, len(approx))
+		}
+		if !sort.Float64sAreSorted(approx) {
+			t.Errorf("max=%d values are not sorted\n", max)
+		}
+		if approx[0] != s.Min() || approx[len(approx)-1] != s.Max() {
+			t.Errorf("max=%d actual-range=%f,%f expected-range=%f,%f\n",
+				max, approx[0], approx[len(approx)-1], s.Min(), s.Max())
+		}
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			expected := exactQuantile(vals, q)
+			actual := Quantile(approx, q, NearestRank)
+			if math.Abs(actual-expected) > math.Abs(expected)*0.05+1 {
+				t.Errorf("max=%d q=%f actual=%f expected=%f\n", max, q, actual, expected)
+			}
+		}
+	}
+}
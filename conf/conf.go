@@ -7,102 +7,242 @@ import (
 	"flag"
 	"net/url"
 	"os"
-	"strings"
 	"time"
 )
 
 type D struct {
-	PrintVersion     bool
-	AppName          string
-	RedisHost        string
-	RedisPass        string
-	MetchanUrl       *url.URL
-	Secrets          []string
-	BufferSize       int
-	Concurrency      int
-	Port             int
-	ReceiverDeadline int64
-	OutletRetries    int
-	OutletTtl        time.Duration
-	MaxPartitions    uint64
-	FlushInterval    time.Duration
-	OutletInterval   time.Duration
-	DataDogApiBase   string
-	UsingReciever    bool
-	UseLibratoOutlet bool
-	UseDataDogOutlet bool
-	Verbose          bool
+	PrintVersion        bool
+	AppName             string
+	RedisHost           string
+	RedisPass           string
+	MetchanUrl          *url.URL
+	Secrets             []string
+	BufferSize          int
+	Concurrency         int
+	Port                int
+	ReceiverDeadline    int64
+	ReceiverWait        time.Duration
+	OutletRetries       int
+	OutletTtl           time.Duration
+	MaxPartitions       uint64
+	FlushInterval       time.Duration
+	OutletInterval      time.Duration
+	OutletBatchSize     int
+	OutletBatchWait     time.Duration
+	ShutdownTimeout     time.Duration
+	RetryDir            string
+	RetryMaxAge         time.Duration
+	RetryBackoff        time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryMaxEntries     int
+	DataDogApiBase      string
+	PrometheusUrl       string
+	UsingReciever       bool
+	UseLibratoOutlet    bool
+	UseDataDogOutlet    bool
+	UsePrometheusOutlet bool
+	UsePrometheusScrape bool
+	HistogramBuckets    string
+	Percentiles         string
+	QuantileMethod      string
+	StatsdAddr          string
+	SyslogTCPAddr       string
+	SyslogUDPAddr       string
+	SyslogAuth          string
+	StatsdAuth          string
+	StatsdResolution    int
+	Verbose             bool
+	// Send measurements to DataDog as distributions.
+	DataDogDistributions bool
+	// YAML file read by Load.
+	ConfigFile string
+	// Per-outlet settings from the config file, by outlet name.
+	Outlets map[string]OutletConf
+	// Per-user limits applied by the receiver.
+	RateLimit RateLimit
+	// Overrides of RateLimit by decrypted user, from the config file.
+	RateLimits map[string]RateLimit
+	// Distinct metric names per user, and distinct sources
+	// per user and name, accepted in each interval.
+	MaxNames, MaxSources int
+	// What happens to buckets over the limits: other or drop.
+	CardinalityOverflow string
+	// Rules the parser applies to every bucket, and rules
+	// for single users that run before them. From the config file.
+	Rules     []Rule
+	UserRules map[string][]Rule
+	// Bearer token for the admin endpoints.
+	// They are disabled when it is empty.
+	AdminToken string
+	// The flags bound to this config and the ones given on
+	// the command line, which take precedence over the file.
+	fs      *flag.FlagSet
+	cmdline map[string]string
 }
 
 // Builds a conf data structure and connects
 // the fields in the struct to flags.
 // It is up to the caller to call flag.Parse()
+// and then Load to read the config file and environment.
 func New() *D {
+	return register(flag.CommandLine)
+}
+
+// Returns a conf with the same defaults as the command line
+// flags. It neither registers flags nor reads the environment,
+// so it is suitable for running l2met inside another program.
+func Defaults() *D {
+	return register(flag.NewFlagSet("l2met", flag.ContinueOnError))
+}
+
+func register(fs *flag.FlagSet) *D {
 	d := new(D)
+	d.fs = fs
+
+	fs.StringVar(&d.ConfigFile, "config", "",
+		"YAML config file. Flags and env vars take precedence over it.")
 
-	flag.BoolVar(&d.PrintVersion, "version", false,
+	fs.BoolVar(&d.PrintVersion, "version", false,
 		"Print l2met version and sha.")
 
-	flag.StringVar(&d.AppName, "app-name", "l2met",
+	fs.StringVar(&d.AppName, "app-name", "l2met",
 		"Prefix internal log messages with this value.")
 
-	flag.IntVar(&d.BufferSize, "buffer", 1024,
+	fs.IntVar(&d.BufferSize, "buffer", 1024,
 		"Max number of items for all internal buffers.")
 
-	flag.IntVar(&d.Concurrency, "concurrency", 10,
+	fs.IntVar(&d.Concurrency, "concurrency", 10,
 		"Number of running go routines for outlet or receiver.")
 
-	flag.IntVar(&d.Port, "port", 8080,
+	fs.IntVar(&d.Port, "port", 8080,
 		"HTTP server's bind port.")
 
-	flag.IntVar(&d.OutletRetries, "outlet-retry", 2,
+	fs.IntVar(&d.OutletRetries, "outlet-retry", 2,
 		"Number of attempts to outlet metrics.")
 
-	flag.Int64Var(&d.ReceiverDeadline, "recv-deadline", 2,
+	fs.Int64Var(&d.ReceiverDeadline, "recv-deadline", 2,
 		"Number of time units to pass before dropping incoming logs.")
 
-	flag.DurationVar(&d.OutletTtl, "outlet-ttl", time.Second*2,
+	fs.DurationVar(&d.ReceiverWait, "recv-wait", time.Second,
+		"Time a request may wait for room in the receiver's inbox before it is refused with a 503.")
+
+	fs.DurationVar(&d.OutletTtl, "outlet-ttl", time.Second*2,
 		"Timeout set on outlet HTTP requests.")
 
-	flag.Uint64Var(&d.MaxPartitions, "partitions", uint64(1),
+	fs.Uint64Var(&d.MaxPartitions, "partitions", uint64(1),
 		"Number of partitions to use for outlets.")
 
-	flag.DurationVar(&d.FlushInterval, "flush-interval", time.Second,
+	fs.DurationVar(&d.FlushInterval, "flush-interval", time.Second,
 		"Time to wait before sending data to store or outlet. "+
 			"Example:60s 30s 1m")
 
-	flag.DurationVar(&d.OutletInterval, "outlet-interval", time.Second,
+	fs.DurationVar(&d.ShutdownTimeout, "shutdown-timeout", time.Second*25,
+		"Time allowed to drain buffered data after SIGTERM before exiting.")
+
+	fs.StringVar(&d.RetryDir, "retry-dir", "",
+		"Directory for payloads outlets failed to post. "+
+			"Failed payloads are only kept in memory when empty.")
+
+	fs.DurationVar(&d.RetryMaxAge, "retry-max-age", time.Hour,
+		"Time to keep retrying a failed payload before dropping it.")
+
+	fs.DurationVar(&d.RetryBackoff, "retry-backoff", time.Second,
+		"Delay before the first retry of a failed payload. Doubles on each attempt.")
+
+	fs.DurationVar(&d.RetryMaxBackoff, "retry-max-backoff", time.Minute*5,
+		"Longest delay between retries of a failed payload.")
+
+	fs.IntVar(&d.RetryMaxEntries, "retry-max-entries", 10000,
+		"Max number of failed payloads kept per outlet. The oldest are dropped first.")
+
+	fs.DurationVar(&d.OutletInterval, "outlet-interval", time.Second,
 		"Time to wait before outlets read buckets from the store. "+
 			"Example:60s 30s 1m")
 
-	flag.BoolVar(&d.UseDataDogOutlet, "outlet-datadog", false,
+	fs.IntVar(&d.OutletBatchSize, "outlet-batch-size", 300,
+		"Max number of points outlets send for a credential in one request.")
+
+	fs.DurationVar(&d.OutletBatchWait, "outlet-batch-wait", time.Millisecond*200,
+		"Time outlets wait for a batch to fill before sending it.")
+
+	fs.BoolVar(&d.UseDataDogOutlet, "outlet-datadog", false,
 		"Start the DataDog outlet.")
 
-	flag.StringVar(&d.DataDogApiBase, "datadog-api-base", "",
+	fs.StringVar(&d.DataDogApiBase, "datadog-api-base", "",
 		"Base url for the DataDog API.")
 
-	flag.BoolVar(&d.UseLibratoOutlet, "outlet-librato", false,
+	fs.BoolVar(&d.DataDogDistributions, "datadog-distributions", false,
+		"Send measurements to DataDog as distribution points instead of gauges.")
+
+	fs.BoolVar(&d.UseLibratoOutlet, "outlet-librato", false,
 		"Start the Librato outlet.")
 
-	flag.BoolVar(&d.UsingReciever, "receiver", false,
+	fs.BoolVar(&d.UsePrometheusOutlet, "outlet-prometheus", false,
+		"Start the Prometheus remote-write outlet.")
+
+	fs.StringVar(&d.PrometheusUrl, "prometheus-url", "",
+		"Prometheus remote-write endpoint.")
+
+	fs.BoolVar(&d.UsePrometheusScrape, "prometheus-scrape", false,
+		"Serve the latest buckets on /metrics for Prometheus to scrape.")
+
+	fs.BoolVar(&d.UsingReciever, "receiver", false,
 		"Enable the Receiver.")
 
-	flag.BoolVar(&d.Verbose, "v", false,
-		"Enable verbose log output.")
+	fs.StringVar(&d.HistogramBuckets, "histogram-buckets",
+		"10,25,50,100,250,500,1000,2500,5000,10000",
+		"Default upper bounds for histogram buckets.")
 
-	d.RedisHost, d.RedisPass, _ = parseRedisUrl(env("REDIS_URL"))
+	fs.StringVar(&d.Percentiles, "percentiles", "50,95,99",
+		"Default percentiles emitted for measurements.")
 
-	// SECRETS are used to decrypt incoming credentials.
-	// You can encrypt the credentials with the secret by hitting /sign, as explained here:
-	//   https://github.com/ryandotsmith/l2met/wiki/Usage#encrypted-librato-credentials
-	d.Secrets = strings.Split(mustenv("SECRETS"), ":")
+	fs.StringVar(&d.QuantileMethod, "quantile-method", "nearest",
+		"How percentiles are computed: nearest (nearest-rank) or linear.")
 
-	if len(env("METCHAN_URL")) > 0 {
-		url, err := url.Parse(env("METCHAN_URL"))
-		if err == nil {
-			d.MetchanUrl = url
-		}
-	}
+	fs.StringVar(&d.StatsdAddr, "statsd-addr", "",
+		"UDP address for StatsD/DogStatsD datagrams. Example: :8125")
+
+	fs.StringVar(&d.StatsdAuth, "statsd-auth", "",
+		"Encrypted credential used for all StatsD datagrams.")
+
+	fs.IntVar(&d.StatsdResolution, "statsd-resolution", 60,
+		"Resolution in seconds of buckets built from StatsD datagrams.")
+
+	fs.StringVar(&d.SyslogTCPAddr, "syslog-tcp-addr", "",
+		"TCP address for RFC5424/RFC3164 syslog messages. Example: :6514")
+
+	fs.StringVar(&d.SyslogUDPAddr, "syslog-udp-addr", "",
+		"UDP address for RFC5424/RFC3164 syslog messages. Example: :514")
+
+	fs.StringVar(&d.SyslogAuth, "syslog-auth", "",
+		"Encrypted credential for syslog messages without l2met structured data.")
+
+	fs.Float64Var(&d.RateLimit.Requests, "rate-limit-requests", 0,
+		"HTTP requests per second allowed for each user. Unlimited when 0.")
+
+	fs.IntVar(&d.RateLimit.RequestBurst, "rate-limit-request-burst", 0,
+		"HTTP requests a user may make at once. Defaults to one second's worth.")
+
+	fs.Float64Var(&d.RateLimit.Buckets, "rate-limit-buckets", 0,
+		"New buckets per second allowed for each user. Unlimited when 0.")
+
+	fs.IntVar(&d.RateLimit.BucketBurst, "rate-limit-bucket-burst", 0,
+		"New buckets a user may create at once. Defaults to one second's worth.")
+
+	fs.IntVar(&d.MaxNames, "max-names", 0,
+		"Distinct metric names each user may send per interval. Unlimited when 0.")
+
+	fs.IntVar(&d.MaxSources, "max-sources", 0,
+		"Distinct sources each user may send per metric name and interval. Unlimited when 0.")
+
+	fs.StringVar(&d.CardinalityOverflow, "cardinality-overflow", "other",
+		"What to do with buckets over -max-names or -max-sources: other (fold them into an other bucket) or drop.")
+
+	fs.StringVar(&d.AdminToken, "admin-token", "",
+		"Bearer token for POST /admin/reload. Disabled when empty.")
+
+	fs.BoolVar(&d.Verbose, "v", false,
+		"Enable verbose log output.")
 	return d
 }
 
@@ -111,14 +251,6 @@ func env(n string) string {
 	return os.Getenv(n)
 }
 
-func mustenv(n string) string {
-	v := env(n)
-	if len(v) == 0 {
-		panic("Must set: " + n)
-	}
-	return v
-}
-
 // Helper Function
 func parseRedisUrl(s string) (string, string, error) {
 	u, err := url.Parse(s)
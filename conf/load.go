@@ -0,0 +1,554 @@
+package conf
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"gopkg.in/yaml.v2"
+)
+
+// Settings that may differ between outlets. Nil fields
+// fall back to the global setting of the same name, so
+// an outlet can still set a value to zero.
+type OutletConf struct {
+	Retries     *int
+	Ttl         *time.Duration
+	Concurrency *int
+	BufferSize  *int
+	BatchSize   *int
+}
+
+// Token bucket limits for one user. Rates are per second and
+// a zero rate is unlimited. Zero bursts default to one second's
+// worth. In the rate-limits section of a config file zero values
+// fall back to the -rate-limit flags.
+type RateLimit struct {
+	Requests     float64
+	RequestBurst int
+	Buckets      float64
+	BucketBurst  int
+}
+
+// Changes or filters the buckets built by the parser. Name and
+// Source are regular expressions; a rule applies to buckets
+// matching both, and an empty expression matches anything.
+// Action is keep, drop or rewrite. Keep and drop stop evaluation.
+// Rewrite, the default, replaces the part of the name matched
+// by Name with Rename, and likewise the source with
+// RewriteSource. Both may use capture groups such as $1.
+// Without an expression the whole value is replaced.
+type Rule struct {
+	Name          string `yaml:"name"`
+	Source        string `yaml:"source"`
+	Action        string `yaml:"action"`
+	Rename        string `yaml:"rename"`
+	RewriteSource string `yaml:"rewrite-source"`
+}
+
+// The outlets that may appear in the outlets section of a
+// config file, and the flags their keys correspond to.
+var outletFlags = map[string]map[string]string{
+	"datadog": {
+		"enabled":       "outlet-datadog",
+		"api-base":      "datadog-api-base",
+		"distributions": "datadog-distributions",
+	},
+	"librato": {
+		"enabled": "outlet-librato",
+	},
+	"prometheus": {
+		"enabled": "outlet-prometheus",
+		"url":     "prometheus-url",
+	},
+	"prometheus-scrape": {
+		"enabled": "prometheus-scrape",
+	},
+}
+
+// All the problems found while loading a config.
+type Errors []string
+
+func (e Errors) Error() string {
+	return "conf: " + strings.Join(e, "; ")
+}
+
+// Fills in the config from the file named by -config and the
+// environment, then validates the result. Command line flags
+// and environment variables take precedence over the file.
+// Every problem is reported in the returned Errors.
+func (d *D) Load() error {
+	var errs Errors
+	if d.cmdline == nil && d.fs != nil {
+		d.cmdline = make(map[string]string)
+		d.fs.Visit(func(f *flag.Flag) {
+			d.cmdline[f.Name] = f.Value.String()
+		})
+	}
+	if len(d.ConfigFile) > 0 {
+		errs = append(errs, d.loadFile(d.ConfigFile)...)
+	}
+	errs = append(errs, d.loadEnv()...)
+	if err := d.Validate(); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// The file is YAML. Top level keys are the names of the
+// command line flags, plus redis-url, secrets, metchan-url,
+// rate-limits, rules, user-rules and an outlets section:
+//
+//	flush-interval: 1s
+//	secrets: [key1, key2]
+//	outlets:
+//	  datadog:
+//	    enabled: true
+//	    retry: 4
+//	    ttl: 5s
+func (d *D) loadFile(path string) Errors {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Errors{err.Error()}
+	}
+	if d.fs == nil {
+		return Errors{"config files need a conf built by New or Defaults"}
+	}
+	var file map[string]interface{}
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return Errors{fmt.Sprintf("%s: %s", path, err)}
+	}
+	set := make(map[string]bool)
+	for name := range d.cmdline {
+		set[name] = true
+	}
+
+	var errs Errors
+	for _, k := range sortedKeys(file) {
+		v := file[k]
+		switch k {
+		case "redis-url":
+			d.RedisHost, d.RedisPass, err = parseRedisUrl(fmt.Sprint(v))
+		case "metchan-url":
+			d.MetchanUrl, err = url.Parse(fmt.Sprint(v))
+		case "secrets":
+			d.Secrets, err = stringList(v)
+		case "outlets":
+			errs = append(errs, d.loadOutlets(v, set)...)
+			continue
+		case "rate-limits":
+			errs = append(errs, d.loadRateLimits(v)...)
+			continue
+		case "rules":
+			err = decode(v, &d.Rules)
+		case "user-rules":
+			err = decode(v, &d.UserRules)
+		case "config":
+			err = errors.New("may only be given as a flag")
+		default:
+			err = d.setFlag(k, v, set)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", k, err))
+		}
+	}
+	return errs
+}
+
+func (d *D) loadOutlets(v interface{}, set map[string]bool) Errors {
+	outlets, ok := stringKeys(v)
+	if !ok {
+		return Errors{"outlets: must be a mapping"}
+	}
+	var errs Errors
+	for _, name := range sortedKeys(outlets) {
+		flags, ok := outletFlags[name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("outlets: unknown outlet %s", name))
+			continue
+		}
+		settings, ok := stringKeys(outlets[name])
+		if !ok {
+			errs = append(errs, fmt.Sprintf("outlets.%s: must be a mapping", name))
+			continue
+		}
+		oc := d.Outlets[name]
+		for _, k := range sortedKeys(settings) {
+			v := settings[k]
+			var err error
+			switch k {
+			case "retry":
+				oc.Retries, err = intSetting(v)
+			case "ttl":
+				var ttl time.Duration
+				if ttl, err = time.ParseDuration(fmt.Sprint(v)); err == nil {
+					oc.Ttl = &ttl
+				}
+			case "interval":
+				// The store is scanned once for every outlet, so this is
+				// ignored. Old config files should still load.
+				fmt.Printf("at=config-deprecated key=outlets.%s.interval msg=%q\n",
+					name, "ignored, set outlet-interval at the top level")
+			case "concurrency":
+				oc.Concurrency, err = intSetting(v)
+			case "buffer":
+				oc.BufferSize, err = intSetting(v)
+			case "batch-size":
+				oc.BatchSize, err = intSetting(v)
+			default:
+				if f, ok := flags[k]; ok {
+					err = d.setFlag(f, v, set)
+				} else {
+					err = errors.New("unknown setting")
+				}
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("outlets.%s.%s: %s", name, k, err))
+			}
+		}
+		if d.Outlets == nil {
+			d.Outlets = make(map[string]OutletConf)
+		}
+		d.Outlets[name] = oc
+	}
+	return errs
+}
+
+// Reads per-user overrides of the rate limit flags:
+//
+//	rate-limits:
+//	  noisy-app:
+//	    requests: 5
+//	    buckets: 100
+func (d *D) loadRateLimits(v interface{}) Errors {
+	users, ok := stringKeys(v)
+	if !ok {
+		return Errors{"rate-limits: must be a mapping"}
+	}
+	var errs Errors
+	for _, user := range sortedKeys(users) {
+		settings, ok := stringKeys(users[user])
+		if !ok {
+			errs = append(errs, fmt.Sprintf("rate-limits.%s: must be a mapping", user))
+			continue
+		}
+		var rl RateLimit
+		for _, k := range sortedKeys(settings) {
+			v := fmt.Sprint(settings[k])
+			var err error
+			switch k {
+			case "requests":
+				rl.Requests, err = strconv.ParseFloat(v, 64)
+			case "request-burst":
+				rl.RequestBurst, err = strconv.Atoi(v)
+			case "buckets":
+				rl.Buckets, err = strconv.ParseFloat(v, 64)
+			case "bucket-burst":
+				rl.BucketBurst, err = strconv.Atoi(v)
+			default:
+				err = errors.New("unknown setting")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("rate-limits.%s.%s: %s", user, k, err))
+			}
+		}
+		if d.RateLimits == nil {
+			d.RateLimits = make(map[string]RateLimit)
+		}
+		d.RateLimits[user] = rl
+	}
+	return errs
+}
+
+// Returns a mapping from the file keyed by strings, so that
+// keys YAML reads as numbers or booleans can be looked up.
+func stringKeys(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	res := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		res[fmt.Sprint(k)] = v
+	}
+	return res, true
+}
+
+func intSetting(v interface{}) (*int, error) {
+	n, err := strconv.Atoi(fmt.Sprint(v))
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// Decodes part of the file into v, rejecting unknown keys.
+func decode(in interface{}, v interface{}) error {
+	b, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(b, v)
+}
+
+// Sets a flag from the file unless it was given on the command line.
+func (d *D) setFlag(name string, v interface{}, set map[string]bool) error {
+	if d.fs.Lookup(name) == nil {
+		return errors.New("unknown setting")
+	}
+	if set[name] {
+		return nil
+	}
+	return d.fs.Set(name, fmt.Sprint(v))
+}
+
+func (d *D) loadEnv() Errors {
+	var errs Errors
+	if s := env("REDIS_URL"); len(s) > 0 {
+		d.RedisHost, d.RedisPass, _ = parseRedisUrl(s)
+	}
+	// SECRETS are used to decrypt incoming credentials.
+	// You can encrypt the credentials with the secret by hitting /sign, as explained here:
+	//   https://github.com/ryandotsmith/l2met/wiki/Usage#encrypted-librato-credentials
+	if s := env("SECRETS"); len(s) > 0 {
+		d.Secrets = strings.Split(s, ":")
+	}
+	if s := env("METCHAN_URL"); len(s) > 0 {
+		u, err := url.Parse(s)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("METCHAN_URL: %s", err))
+		} else {
+			d.MetchanUrl = u
+		}
+	}
+	return errs
+}
+
+// Checks the config for values l2met can't run with.
+// Returns Errors listing every problem found.
+func (d *D) Validate() error {
+	var errs Errors
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+	check(d.BufferSize > 0, "buffer must be positive")
+	check(d.Concurrency > 0, "concurrency must be positive")
+	check(d.MaxPartitions > 0, "partitions must be positive")
+	check(d.OutletBatchSize > 0, "outlet-batch-size must be positive")
+	check(d.Port > 0 && d.Port < 1<<16, "port %d is out of range", d.Port)
+	check(d.OutletRetries >= 0, "outlet-retry must not be negative")
+	check(d.ReceiverWait >= 0, "recv-wait must not be negative")
+	check(d.RetryMaxEntries > 0, "retry-max-entries must be positive")
+	for name, v := range map[string]time.Duration{
+		"flush-interval":    d.FlushInterval,
+		"outlet-interval":   d.OutletInterval,
+		"outlet-ttl":        d.OutletTtl,
+		"outlet-batch-wait": d.OutletBatchWait,
+		"shutdown-timeout":  d.ShutdownTimeout,
+		"retry-max-age":     d.RetryMaxAge,
+		"retry-backoff":     d.RetryBackoff,
+		"retry-max-backoff": d.RetryMaxBackoff,
+	} {
+		check(v > 0, "%s must be positive", name)
+	}
+	for name, oc := range d.Outlets {
+		check(oc.Retries == nil || *oc.Retries >= 0,
+			"outlets.%s: retry must not be negative", name)
+		check(positive(oc.Concurrency) && positive(oc.BufferSize) &&
+			positive(oc.BatchSize) && (oc.Ttl == nil || *oc.Ttl > 0),
+			"outlets.%s: settings other than retry must be positive", name)
+	}
+	check(!d.RateLimit.negative(), "rate-limit settings must not be negative")
+	for user, rl := range d.RateLimits {
+		check(!rl.negative(), "rate-limits.%s: settings must not be negative", user)
+	}
+	check(d.MaxNames >= 0 && d.MaxSources >= 0,
+		"max-names and max-sources must not be negative")
+	check(d.CardinalityOverflow == "other" || d.CardinalityOverflow == "drop",
+		"cardinality-overflow must be other or drop")
+	for i, r := range d.Rules {
+		if err := r.validate(); err != nil {
+			check(false, "rules[%d]: %s", i, err)
+		}
+	}
+	for user, rules := range d.UserRules {
+		for i, r := range rules {
+			if err := r.validate(); err != nil {
+				check(false, "user-rules.%s[%d]: %s", user, i, err)
+			}
+		}
+	}
+	usesAuth := d.UsingReciever || d.UseDataDogOutlet || d.UseLibratoOutlet ||
+		d.UsePrometheusOutlet || d.UsePrometheusScrape
+	check(!usesAuth || len(d.Secrets) > 0,
+		"secrets are required to decrypt credentials for the receiver and outlets")
+	check(len(d.StatsdAddr) == 0 || len(d.StatsdAuth) > 0,
+		"statsd-addr requires statsd-auth")
+	if _, err := bucket.ParseBounds(d.HistogramBuckets); err != nil {
+		check(false, "histogram-buckets: %s", err)
+	}
+	if _, err := bucket.ParsePercentiles(d.Percentiles); err != nil {
+		check(false, "percentiles: %s", err)
+	}
+	if _, err := bucket.ParseQuantileMethod(d.QuantileMethod); err != nil {
+		check(false, "quantile-method: %s", err)
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errs
+	}
+	return nil
+}
+
+// Builds a new config from the same command line flags,
+// re-reading the config file and environment. d itself is
+// left untouched, so a bad file doesn't disturb a running
+// config.
+func (d *D) Reload() (*D, error) {
+	if d.fs == nil {
+		return nil, Errors{"reloading needs a conf built by New or Defaults"}
+	}
+	n := register(flag.NewFlagSet(d.fs.Name(), flag.ContinueOnError))
+	for name, v := range d.cmdline {
+		n.fs.Set(name, v)
+	}
+	n.cmdline = d.cmdline
+	n.ConfigFile = d.ConfigFile
+	if err := n.Load(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Returns a copy of the config with the settings
+// for the named outlet applied.
+func (d *D) ForOutlet(name string) *D {
+	c := *d
+	oc := d.Outlets[name]
+	if oc.Retries != nil {
+		c.OutletRetries = *oc.Retries
+	}
+	if oc.Ttl != nil {
+		c.OutletTtl = *oc.Ttl
+	}
+	if oc.Concurrency != nil {
+		c.Concurrency = *oc.Concurrency
+	}
+	if oc.BufferSize != nil {
+		c.BufferSize = *oc.BufferSize
+	}
+	if oc.BatchSize != nil {
+		c.OutletBatchSize = *oc.BatchSize
+	}
+	return &c
+}
+
+// Reports whether the named outlet is turned on.
+func (d *D) OutletEnabled(name string) bool {
+	switch name {
+	case "datadog":
+		return d.UseDataDogOutlet
+	case "librato":
+		return d.UseLibratoOutlet
+	case "prometheus":
+		return d.UsePrometheusOutlet
+	case "prometheus-scrape":
+		return d.UsePrometheusScrape
+	}
+	return false
+}
+
+// Returns the rate limits for the decrypted user,
+// with their overrides applied.
+func (d *D) RateLimitFor(user string) RateLimit {
+	rl := d.RateLimit
+	o := d.RateLimits[user]
+	// A rate given without a burst gets its own default
+	// burst rather than the one for the flag's rate.
+	if o.Requests > 0 {
+		rl.Requests, rl.RequestBurst = o.Requests, 0
+	}
+	if o.RequestBurst > 0 {
+		rl.RequestBurst = o.RequestBurst
+	}
+	if o.Buckets > 0 {
+		rl.Buckets, rl.BucketBurst = o.Buckets, 0
+	}
+	if o.BucketBurst > 0 {
+		rl.BucketBurst = o.BucketBurst
+	}
+	return rl
+}
+
+func (r Rule) validate() error {
+	for _, expr := range []string{r.Name, r.Source} {
+		if _, err := regexp.Compile(expr); err != nil {
+			return err
+		}
+	}
+	switch r.Action {
+	case "keep", "drop":
+		if len(r.Rename) > 0 || len(r.RewriteSource) > 0 {
+			return fmt.Errorf("%s rules can't rename or rewrite-source", r.Action)
+		}
+	case "", "rewrite":
+		if len(r.Rename) == 0 && len(r.RewriteSource) == 0 {
+			return errors.New("rewrite rules need rename or rewrite-source")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+func (rl RateLimit) negative() bool {
+	return rl.Requests < 0 || rl.RequestBurst < 0 || rl.Buckets < 0 || rl.BucketBurst < 0
+}
+
+func stringList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return strings.Split(v, ":"), nil
+	case []interface{}:
+		a := make([]string, len(v))
+		for i := range v {
+			a[i] = fmt.Sprint(v[i])
+		}
+		return a, nil
+	}
+	return nil, errors.New("must be a string or a list")
+}
+
+// Unset outlet settings fall back to checked globals.
+func positive(n *int) bool {
+	return n == nil || *n > 0
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]interface{}:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[interface{}]interface{}:
+		for k := range m {
+			keys = append(keys, fmt.Sprint(k))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,250 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	dir, err := ioutil.TempDir("", "l2met-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "l2met.yml")
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `
+receiver: true
+flush-interval: 5s
+concurrency: 3
+secrets: [abc, def]
+redis-url: redis://:pass@localhost:6379
+outlets:
+  datadog:
+    enabled: true
+    api-base: http://localhost/api
+    retry: 4
+    ttl: 10s
+    interval: 5s
+  librato:
+    retry: 0
+  prometheus-scrape:
+    enabled: true
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Unsetenv("SECRETS")
+	os.Unsetenv("REDIS_URL")
+	d := Defaults()
+	d.fs.Parse([]string{"-config", path, "-concurrency", "7"})
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !d.UsingReciever || !d.UseDataDogOutlet {
+		t.Errorf("expected receiver and datadog outlet to be enabled\n")
+	}
+	if d.FlushInterval != 5*time.Second {
+		t.Errorf("actual=%s expected=5s\n", d.FlushInterval)
+	}
+	// The command line wins over the file.
+	if d.Concurrency != 7 {
+		t.Errorf("actual=%d expected=7\n", d.Concurrency)
+	}
+	if strings.Join(d.Secrets, ":") != "abc:def" {
+		t.Errorf("actual=%v expected=[abc def]\n", d.Secrets)
+	}
+	if d.RedisHost != "localhost:6379" || d.RedisPass != "pass" {
+		t.Errorf("actual=%s,%s expected=localhost:6379,pass\n", d.RedisHost, d.RedisPass)
+	}
+	if d.DataDogApiBase != "http://localhost/api" {
+		t.Errorf("actual=%s expected=http://localhost/api\n", d.DataDogApiBase)
+	}
+	dd := d.ForOutlet("datadog")
+	if dd.OutletRetries != 4 || dd.OutletTtl != 10*time.Second {
+		t.Errorf("actual=%d,%s expected=4,10s\n", dd.OutletRetries, dd.OutletTtl)
+	}
+	if dd.Concurrency != 7 || d.OutletRetries != 2 {
+		t.Errorf("outlet settings should not leak into the global config\n")
+	}
+	// Zero turns retries off rather than falling back to the global.
+	if l := d.ForOutlet("librato"); l.OutletRetries != 0 {
+		t.Errorf("actual=%d expected=0\n", l.OutletRetries)
+	}
+	if !d.UsePrometheusScrape {
+		t.Errorf("expected the prometheus-scrape outlet to be enabled\n")
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, "secrets: fromfile\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Setenv("SECRETS", "fromenv")
+	defer os.Unsetenv("SECRETS")
+	d := Defaults()
+	d.ConfigFile = path
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Secrets) != 1 || d.Secrets[0] != "fromenv" {
+		t.Errorf("actual=%v expected=[fromenv]\n", d.Secrets)
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	path := writeConfig(t, `
+receiver: true
+flush-interval: soon
+partitions: 0
+bogus: 1
+outlets:
+  datadog:
+    ttl: -1s
+  graphite:
+    enabled: true
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Unsetenv("SECRETS")
+	d := Defaults()
+	d.ConfigFile = path
+	err := d.Load()
+	if err == nil {
+		t.Fatalf("expected errors\n")
+	}
+	errs := err.(Errors)
+	for _, expected := range []string{
+		"flush-interval:",
+		"bogus: unknown setting",
+		"outlets: unknown outlet graphite",
+		"outlets.datadog: settings other than retry must be positive",
+		"partitions must be positive",
+		"secrets are required",
+	} {
+		found := false
+		for _, e := range errs {
+			if strings.HasPrefix(e, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing=%q errors=%v\n", expected, errs)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	if err := Defaults().Validate(); err != nil {
+		t.Errorf("error=%s\n", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeConfig(t, "flush-interval: 5s\nconcurrency: 3\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	d := Defaults()
+	d.fs.Parse([]string{"-config", path, "-concurrency", "7"})
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, []byte("flush-interval: 9s\nconcurrency: 3\n"), 0600)
+	n, err := d.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.FlushInterval != 9*time.Second || n.Concurrency != 7 {
+		t.Errorf("actual=%s,%d expected=9s,7\n", n.FlushInterval, n.Concurrency)
+	}
+	if d.FlushInterval != 5*time.Second {
+		t.Errorf("reload changed the running config\n")
+	}
+	ioutil.WriteFile(path, []byte("flush-interval: never\n"), 0600)
+	if _, err := n.Reload(); err == nil {
+		t.Errorf("expected error for bad duration\n")
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	path := writeConfig(t, `
+rate-limit-requests: 10
+rate-limit-request-burst: 50
+rate-limits:
+  noisy:
+    requests: 2
+  bulk:
+    buckets: 500
+    bucket-burst: 1000
+  12345:
+    requests: 3
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	d := Defaults()
+	d.ConfigFile = path
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user     string
+		expected RateLimit
+	}{
+		{"other", RateLimit{Requests: 10, RequestBurst: 50}},
+		{"noisy", RateLimit{Requests: 2}},
+		{"12345", RateLimit{Requests: 3}},
+		{"bulk", RateLimit{Requests: 10, RequestBurst: 50, Buckets: 500, BucketBurst: 1000}},
+	}
+	for _, c := range cases {
+		if actual := d.RateLimitFor(c.user); actual != c.expected {
+			t.Errorf("user=%s actual=%+v expected=%+v\n", c.user, actual, c.expected)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := writeConfig(t, `
+rules:
+  - name: '^debug\.'
+    action: drop
+  - source: '^web\.\d+$'
+    rewrite-source: web
+user-rules:
+  app:
+    - name: '^(\w+)\.count$'
+      rename: '$1.total'
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	d := Defaults()
+	d.ConfigFile = path
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Rules) != 2 || d.Rules[1].RewriteSource != "web" {
+		t.Errorf("actual=%+v\n", d.Rules)
+	}
+	if len(d.UserRules["app"]) != 1 || d.UserRules["app"][0].Rename != "$1.total" {
+		t.Errorf("actual=%+v\n", d.UserRules)
+	}
+
+	cases := []struct {
+		rule     Rule
+		expected string
+	}{
+		{Rule{Name: "(", Action: "drop"}, "error parsing regexp"},
+		{Rule{Name: "x", Action: "allow"}, `unknown action "allow"`},
+		{Rule{Name: "x"}, "rewrite rules need rename or rewrite-source"},
+		{Rule{Name: "x", Action: "drop", Rename: "y"}, "drop rules can't rename"},
+	}
+	for _, c := range cases {
+		d := Defaults()
+		d.Rules = []Rule{c.rule}
+		err := d.Validate()
+		if err == nil || !strings.Contains(err.Error(), "rules[0]: "+c.expected) {
+			t.Errorf("rule=%+v actual=%v expected=%q\n", c.rule, err, c.expected)
+		}
+	}
+}
@@ -2,18 +2,28 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
 	"github.com/DataDog/l2met/conf"
 	"github.com/DataDog/l2met/metchan"
 	"github.com/DataDog/l2met/metrics"
 	"github.com/DataDog/l2met/outlet"
+	"github.com/DataDog/l2met/parser"
 	"github.com/DataDog/l2met/reader"
 	"github.com/DataDog/l2met/receiver"
 	"github.com/DataDog/l2met/store"
@@ -22,12 +32,94 @@ import (
 // Hold onto the app's global config.
 var cfg *conf.D
 
+// Components that hold buffered data and must be drained
+// on shutdown.
+type stopper interface {
+	Stop()
+}
+
+// Components whose settings can change while running.
+type reloader interface {
+	Reload(cfg *conf.D)
+}
+
+var (
+	// Closed when shutdown begins.
+	shuttingDown = make(chan struct{})
+	// StatsD and syslog listeners to close on shutdown.
+	listeners []io.Closer
+	// Reload requests from the admin endpoint. Reloads are
+	// handled by main so that cfg is only swapped there.
+	reloads = make(chan chan error)
+)
+
 func init() {
 	cfg = conf.New()
+}
+
+// Reads the config file and environment, reporting every
+// problem before exiting. Then hands the settings that are
+// package defaults to their packages.
+func loadConfig() {
 	flag.Parse()
+	if err := cfg.Load(); err != nil {
+		logConfigErrors(err)
+		os.Exit(1)
+	}
+	if len(cfg.Secrets) > 0 {
+		if err := auth.SetKeys(cfg.Secrets); err != nil {
+			fmt.Printf("error=config msg=%q\n", "secrets: "+err.Error())
+			os.Exit(1)
+		}
+	}
 	if len(cfg.DataDogApiBase) > 0 {
 		metrics.DataDogUrl = cfg.DataDogApiBase
 	}
+	if len(cfg.PrometheusUrl) > 0 {
+		metrics.PrometheusUrl = cfg.PrometheusUrl
+	}
+	// Validated by Load.
+	parser.DefaultHistogramBuckets = cfg.HistogramBuckets
+	parser.DefaultPercentiles = cfg.Percentiles
+	bucket.DefaultQuantileMethod, _ = bucket.ParseQuantileMethod(cfg.QuantileMethod)
+	rules, _ := parser.NewRuleSet(cfg.Rules, cfg.UserRules)
+	parser.SetRules(rules)
+}
+
+func logConfigErrors(err error) {
+	errs, ok := err.(conf.Errors)
+	if !ok {
+		errs = conf.Errors{err.Error()}
+	}
+	for _, e := range errs {
+		fmt.Printf("error=config msg=%q\n", e)
+	}
+}
+
+// Re-reads the config and applies what can change while
+// running: the secrets, the parser rules, the receiver's limits,
+// the reader's scan interval and each outlet's retries. The running
+// config is kept if the new one is bad.
+func reload(reloaders map[string]reloader) error {
+	n, err := cfg.Reload()
+	if err != nil {
+		logConfigErrors(err)
+		return err
+	}
+	if err := auth.SetKeys(n.Secrets); err != nil {
+		err = conf.Errors{"secrets: " + err.Error()}
+		logConfigErrors(err)
+		return err
+	}
+	// Validated by Reload.
+	rules, _ := parser.NewRuleSet(n.Rules, n.UserRules)
+	parser.SetRules(rules)
+	for name, r := range reloaders {
+		r.Reload(n.ForOutlet(name))
+	}
+	cfg = n
+	fmt.Printf("at=reload\n")
+	return nil
 }
 
 func init() {
@@ -35,6 +127,7 @@ func init() {
 }
 
 func main() {
+	loadConfig()
 	if cfg.PrintVersion {
 		fmt.Println(conf.Version)
 		os.Exit(0)
@@ -42,8 +135,9 @@ func main() {
 
 	// Can be passed to other modules
 	// as an internal metrics channel.
+	ctx := context.Background()
 	mchan := metchan.New(cfg)
-	mchan.Start()
+	mchan.Start(ctx)
 
 	// The store will be used by receivers and outlets.
 	var st store.Store
@@ -57,34 +151,200 @@ func main() {
 		fmt.Printf("at=initialized-mem-store\n")
 	}
 
-	if cfg.UseLibratoOutlet {
-		rdr := reader.New(cfg, st)
-		rdr.Mchan = mchan
-		outlet := outlet.NewLibratoOutlet(cfg, rdr)
-		outlet.Mchan = mchan
-		outlet.Start()
-	}
+	var recv *receiver.Receiver
+	var outlets []stopper
+	reloaders := make(map[string]reloader)
 
-	if cfg.UseDataDogOutlet {
-		rdr := reader.New(cfg, st)
-		rdr.Mchan = mchan
-		outlet := outlet.NewDataDogOutlet(cfg, rdr)
-		outlet.Mchan = mchan
-		outlet.Start()
+	// A single reader scans the store and hands every bucket
+	// to each enabled outlet through its own buffer.
+	rdr := reader.New(cfg, st)
+	rdr.Mchan = mchan
+	outlets = append(outlets, rdr)
+	reloaders["reader"] = rdr
+	for _, name := range outlet.Names() {
+		if !cfg.OutletEnabled(name) {
+			continue
+		}
+		ocfg := cfg.ForOutlet(name)
+		in := rdr.Subscribe(name, ocfg.BufferSize)
+		o, err := outlet.New(name, ocfg, in, mchan)
+		if err != nil {
+			fmt.Printf("error=%s\n", err)
+			os.Exit(1)
+		}
+		o.Start(ctx)
+		outlets = append(outlets, o)
+		reloaders[name] = o
+		// Outlets that serve their metrics, like the
+		// prometheus scrape outlet, are scraped on /metrics.
+		if h, ok := o.(http.Handler); ok {
+			http.Handle("/metrics", h)
+		}
 	}
+	rdr.Start(ctx)
 
 	if cfg.UsingReciever {
-		recv := receiver.NewReceiver(cfg, st)
+		recv = receiver.NewReceiver(cfg, st)
 		recv.Mchan = mchan
-		recv.Start()
+		recv.Start(ctx)
+		reloaders["receiver"] = recv
 		http.Handle("/logs", recv)
+		if len(cfg.StatsdAddr) > 0 {
+			serveStatsd(recv)
+		}
+		if len(cfg.SyslogTCPAddr) > 0 || len(cfg.SyslogUDPAddr) > 0 {
+			serveSyslog(recv)
+		}
 	}
 
 	http.Handle("/health", st)
-	http.HandleFunc("/sign", auth.ServeHTTP)
-	e := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), nil)
-	if e != nil {
-		log.Fatal("Unable to start HTTP server.")
+	http.HandleFunc("/sign", auth.Sign(outlet.Names()))
+	if len(cfg.AdminToken) > 0 {
+		http.HandleFunc("/admin/reload", serveReload(cfg.AdminToken))
 	}
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+	go func() {
+		e := srv.ListenAndServe()
+		if e != nil && e != http.ErrServerClosed {
+			log.Fatal("Unable to start HTTP server.")
+		}
+	}()
 	fmt.Printf("at=l2met-initialized port=%d\n", cfg.Port)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				reload(reloaders)
+				continue
+			}
+			fmt.Printf("at=shutdown signal=%s\n", s)
+			shutdown(srv, recv, append(outlets, mchan))
+			return
+		case done := <-reloads:
+			done <- reload(reloaders)
+		}
+	}
+}
+
+// Triggers a reload on POST with the admin token as a bearer
+// token, responding with the config errors if it fails.
+func serveReload(token string) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method must be POST.", 400)
+			return
+		}
+		actual := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			http.Error(w, "Unauthorized.", 401)
+			return
+		}
+		done := make(chan error, 1)
+		select {
+		case reloads <- done:
+		case <-shuttingDown:
+			http.Error(w, "Shutting down.", 503)
+			return
+		}
+		if err := <-done; err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// Stops accepting data and drains it through the store and
+// outlets. Exits non-zero if this takes longer than the
+// configured shutdown timeout.
+func shutdown(srv *http.Server, recv *receiver.Receiver, outlets []stopper) {
+	deadline := time.Now().Add(cfg.ShutdownTimeout)
+	close(shuttingDown)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("at=shutdown error=%s\n", err)
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		if recv != nil {
+			recv.Stop()
+			fmt.Printf("at=shutdown component=receiver\n")
+		}
+		// Outlets are stopped in order: the reader first so
+		// they can drain, the internal metrics channel last.
+		for _, o := range outlets {
+			o.Stop()
+		}
+		fmt.Printf("at=shutdown component=outlets\n")
+	}()
+	select {
+	case <-done:
+		fmt.Printf("at=shutdown-complete\n")
+	case <-time.After(time.Until(deadline)):
+		fmt.Printf("at=shutdown-timeout timeout=%s\n", cfg.ShutdownTimeout)
+		os.Exit(1)
+	}
+}
+
+// Fails unless the listener was closed by shutdown.
+func serveFailed(err error) {
+	select {
+	case <-shuttingDown:
+	default:
+		log.Fatal(err)
+	}
+}
+
+func serveStatsd(recv *receiver.Receiver) {
+	if _, err := auth.DecryptCredential(cfg.StatsdAuth); err != nil {
+		log.Fatal("Unable to decrypt -statsd-auth.")
+	}
+	conn, err := net.ListenPacket("udp", cfg.StatsdAddr)
+	if err != nil {
+		log.Fatal("Unable to start StatsD listener.")
+	}
+	listeners = append(listeners, conn)
+	fmt.Printf("at=statsd-initialized addr=%s\n", cfg.StatsdAddr)
+	opts := map[string][]string{
+		"auth":       []string{cfg.StatsdAuth},
+		"resolution": []string{strconv.Itoa(cfg.StatsdResolution)},
+	}
+	go func() { serveFailed(recv.ServeStatsd(conn, opts)) }()
+}
+
+func serveSyslog(recv *receiver.Receiver) {
+	opts := make(map[string][]string)
+	if len(cfg.SyslogAuth) > 0 {
+		if _, err := auth.DecryptCredential(cfg.SyslogAuth); err != nil {
+			log.Fatal("Unable to decrypt -syslog-auth.")
+		}
+		opts["auth"] = []string{cfg.SyslogAuth}
+	}
+	if len(cfg.SyslogTCPAddr) > 0 {
+		l, err := net.Listen("tcp", cfg.SyslogTCPAddr)
+		if err != nil {
+			log.Fatal("Unable to start syslog TCP listener.")
+		}
+		listeners = append(listeners, l)
+		fmt.Printf("at=syslog-tcp-initialized addr=%s\n", cfg.SyslogTCPAddr)
+		go func() { serveFailed(recv.ServeSyslogTCP(l, opts)) }()
+	}
+	if len(cfg.SyslogUDPAddr) > 0 {
+		conn, err := net.ListenPacket("udp", cfg.SyslogUDPAddr)
+		if err != nil {
+			log.Fatal("Unable to start syslog UDP listener.")
+		}
+		listeners = append(listeners, conn)
+		fmt.Printf("at=syslog-udp-initialized addr=%s\n", cfg.SyslogUDPAddr)
+		go func() { serveFailed(recv.ServeSyslogUDP(conn, opts)) }()
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -191,7 +192,8 @@ func receiveInput(opts testOps, msg []byte) ([]*bucket.Bucket, error) {
 	st.Mchan = new(metchan.Channel)
 	recv := receiver.NewReceiver(cfg, st)
 	recv.Mchan = new(metchan.Channel)
-	recv.Start()
+	recv.Start(context.Background())
+	defer recv.Stop()
 	recv.Receive(msg, opts)
 	recv.Wait()
 	d, err := time.ParseDuration(opts["resolution"][0] + "s")
@@ -4,6 +4,7 @@
 package metchan
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -16,6 +17,8 @@ import (
 	"github.com/DataDog/l2met/metrics"
 )
 
+// A nil Channel discards everything it is given, so
+// components work without an internal metrics channel.
 type Channel struct {
 	// The time by which metchan will aggregate internal metrics.
 	FlushInterval time.Duration
@@ -31,6 +34,9 @@ type Channel struct {
 	source     string
 	appName    string
 	numOutlets int
+	cancel     context.CancelFunc
+	// Tracks the flush and outlet routines.
+	flushing, outleting sync.WaitGroup
 }
 
 // Returns an initialized Metchan Channel.
@@ -75,15 +81,27 @@ func New(cfg *conf.D) *Channel {
 	return c
 }
 
-func (c *Channel) Start() {
+// Flushes and posts metrics until ctx is done or Stop is called.
+func (c *Channel) Start(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
 	if c.Enabled {
-		go c.scheduleFlush()
+		c.flushing.Add(1)
+		go c.scheduleFlush(ctx)
+		c.outleting.Add(c.numOutlets)
 		for i := 0; i < c.numOutlets; i++ {
 			go c.outlet()
 		}
 	}
 }
 
+// Flushes the buffered metrics one last time and
+// returns once they have been posted.
+func (c *Channel) Stop() {
+	c.cancel()
+	c.flushing.Wait()
+	c.outleting.Wait()
+}
+
 // Provide the time at which you started your measurement.
 // Places the measurement in a buffer to be aggregated and
 // eventually flushed upstream.
@@ -93,6 +111,9 @@ func (c *Channel) Time(name string, t time.Time) {
 }
 
 func (c *Channel) Measure(name string, v float64) {
+	if c == nil {
+		return
+	}
 	if c.verbose {
 		fmt.Printf("source=%s measure#%s=%f\n", c.source, name, v)
 	}
@@ -111,14 +132,31 @@ func (c *Channel) Measure(name string, v float64) {
 }
 
 func (c *Channel) CountReq(user string) {
-	if !c.Enabled {
+	c.countUser("receiver.requests", "requests", user)
+}
+
+// Counts requests or buckets refused because
+// the user exceeded the named rate limit.
+func (c *Channel) CountThrottle(user, limit string) {
+	c.countUser("receiver.throttled."+limit, limit, user)
+}
+
+// Counts buckets folded or dropped because the user
+// exceeded the named cardinality limit.
+func (c *Channel) CountOverflow(user, limit string) {
+	c.countUser("receiver.cardinality."+limit, "buckets", user)
+}
+
+// Increments a counter whose source is the user.
+func (c *Channel) countUser(name, units, user string) {
+	if c == nil || !c.Enabled {
 		return
 	}
 	usr := strings.Replace(user, "@", "_at_", -1)
 	id := &bucket.Id{
 		Resolution: c.FlushInterval,
-		Name:       c.appName + "." + "receiver.requests",
-		Units:      "requests",
+		Name:       c.appName + "." + name,
+		Units:      units,
 		Source:     usr,
 		Type:       "counter",
 	}
@@ -148,9 +186,19 @@ func (c *Channel) getBucket(id *bucket.Id) *bucket.Bucket {
 	return b
 }
 
-func (c *Channel) scheduleFlush() {
-	for _ = range time.Tick(c.FlushInterval) {
-		c.flush()
+func (c *Channel) scheduleFlush(ctx context.Context) {
+	defer c.flushing.Done()
+	ticker := time.NewTicker(c.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-ctx.Done():
+			c.flush()
+			close(c.outbox)
+			return
+		}
 	}
 }
 
@@ -169,6 +217,7 @@ func (c *Channel) flush() {
 }
 
 func (c *Channel) outlet() {
+	defer c.outleting.Done()
 	for met := range c.outbox {
 		if err := c.post(met); err != nil {
 			fmt.Printf("at=metchan-post error=%s\n", err)
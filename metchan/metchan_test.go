@@ -1,21 +1,31 @@
 package metchan
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metrics"
 )
 
-func serve(buf *[]string) (*url.URL, *httptest.Server) {
+type recorder struct {
+	sync.Mutex
+	bodies []string
+}
+
+func serve(rec *recorder) (*url.URL, *httptest.Server) {
 	f := func(w http.ResponseWriter, r *http.Request) {
 		tmp, _ := ioutil.ReadAll(r.Body)
-		*buf = append(*buf, string(tmp))
+		rec.Lock()
+		rec.bodies = append(rec.bodies, string(tmp))
+		rec.Unlock()
 	}
 	srv := httptest.NewServer(http.HandlerFunc(f))
 	u, _ := url.Parse(srv.URL)
@@ -43,39 +53,42 @@ var metTests = []struct {
 
 func TestMetchan(t *testing.T) {
 	for _, ts := range metTests {
-		actual := make([]string, len(ts.out))
-		u, srv := serve(&actual)
+		rec := new(recorder)
+		u, srv := serve(rec)
 		c := &conf.D{
-			AppName:    "l2met-test",
-			Verbose:    false,
-			MetchanUrl: u,
+			AppName:     "l2met-test",
+			Verbose:     false,
+			MetchanUrl:  u,
+			Concurrency: 1,
+			BufferSize:  100,
 		}
 		mchan := New(c)
-		mchan.FlushInterval = time.Millisecond * 500
-		mchan.Start()
+		mchan.FlushInterval = time.Hour
+		mchan.Start(context.Background())
 		mchan.Time(ts.inName, ts.start)
-		time.Sleep(mchan.FlushInterval * 2)
+		// Stop flushes what is buffered and waits for the posts.
+		mchan.Stop()
 		srv.Close()
-		for i := range actual {
-			compareResult(t, actual[i], ts.out)
+		if len(rec.bodies) == 0 {
+			t.Fatalf("expected metrics to be posted\n")
+		}
+		for i := range rec.bodies {
+			compareResult(t, rec.bodies[i], ts.out)
 		}
 	}
 }
 
 func compareResult(t *testing.T, actual string, possible []string) {
-	if len(actual) == 0 {
-		return
-	}
-	p := new(libratoGauge)
-	if err := json.Unmarshal([]byte(actual), &p); err != nil {
+	p := new(metrics.DataDogRequest)
+	if err := json.Unmarshal([]byte(actual), p); err != nil {
 		t.Fatalf("input=%s error=%s\n", actual, err)
 	}
 	for i := range possible {
-		for j := range p.Gauges {
-			if possible[i] == p.Gauges[j].Name {
+		for j := range p.Series {
+			if possible[i] == p.Series[j].Metric {
 				return
 			}
 		}
 	}
-	t.Fatalf("Expected to find %s in %v\n", p.Gauges, possible)
+	t.Fatalf("Expected to find %s in %v\n", actual, possible)
 }
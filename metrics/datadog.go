@@ -6,7 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 
 	"github.com/DataDog/l2met/bucket"
 	"github.com/DataDog/l2met/conf"
@@ -29,10 +33,48 @@ type DataDog struct {
 	Points []point  `json:"points"`
 }
 
+// A timestamp and every value seen at it.
+type distributionPoint [2]interface{}
+
+// A series for the distribution points API. Datadog computes
+// percentiles from the values, so they can be aggregated across
+// sources. Requests hold them in a series array like DataDogRequest.
+type DataDogDistribution struct {
+	Metric string              `json:"metric"`
+	Host   string              `json:"host,omitempty"`
+	Tags   []string            `json:"tags,omitempty"`
+	Type   string              `json:"type"`
+	Auth   string              `json:"-"`
+	Points []distributionPoint `json:"points"`
+}
+
+// Convert a metric holding Values into a distribution.
+func DataDogConvertDistribution(m *bucket.Metric) *DataDogDistribution {
+	return &DataDogDistribution{
+		Metric: m.Name,
+		Tags:   m.Tags,
+		Type:   "distribution",
+		Auth:   m.Auth,
+		Points: []distributionPoint{{float64(m.Time), m.Values}},
+	}
+}
+
+// The distribution points API next to a series URL: the last
+// element of the path is replaced with distribution_points.
+func DataDogDistributionUrl(seriesUrl string) (string, error) {
+	u, err := url.Parse(seriesUrl)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(path.Dir(u.Path), "distribution_points")
+	return u.String(), nil
+}
+
 // Create a datadog metric for a metric and the requested metric type
 func DataDogComplexMetric(m *bucket.Metric, mtype string) *DataDog {
 	d := &DataDog{
 		Type: "gauge",
+		Tags: m.Tags,
 		Auth: m.Auth,
 	}
 	switch mtype {
@@ -71,9 +113,14 @@ func (d DataDogConverter) Convert() []*DataDog {
 		metrics = append(metrics, DataDogComplexMetric(m, "sum"))
 		metrics = append(metrics, DataDogComplexMetric(m, "count"))
 	} else {
+		name := m.Name
+		if m.Le != nil {
+			name += ".bucket.le_" + DataDogBound(*m.Le)
+		}
 		d := &DataDog{
-			Metric: m.Name,
+			Metric: name,
 			Type:   "gauge",
+			Tags:   m.Tags,
 			Auth:   m.Auth,
 			Points: []point{{float64(m.Time), *m.Val}},
 		}
@@ -83,6 +130,14 @@ func (d DataDogConverter) Convert() []*DataDog {
 
 }
 
+// Formats a histogram bound for use in a metric name.
+func DataDogBound(le float64) string {
+	if math.IsInf(le, 1) {
+		return "inf"
+	}
+	return strconv.FormatFloat(le, 'g', -1, 64)
+}
+
 func (d DataDogConverter) Post(url, api_key string) error {
 	metrics := d.Convert()
 	if len(metrics) == 0 {
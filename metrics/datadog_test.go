@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/DataDog/l2met/bucket"
+)
+
+func TestDataDogConvertTags(t *testing.T) {
+	val := float64(1)
+	m := &bucket.Metric{
+		Name: "hello",
+		Time: 1,
+		Val:  &val,
+		Tags: []string{"dyno:web.1", "region:us"},
+	}
+	for _, d := range (DataDogConverter{Src: m}).Convert() {
+		if !reflect.DeepEqual(d.Tags, m.Tags) {
+			t.Fatalf("actual=%v expected=%v\n", d.Tags, m.Tags)
+		}
+	}
+}
+
+func TestDataDogConvertHistogram(t *testing.T) {
+	val := float64(3)
+	for _, le := range []float64{0.5, math.Inf(1)} {
+		le := le
+		m := &bucket.Metric{Name: "latency", Val: &val, Le: &le}
+		d := (DataDogConverter{Src: m}).Convert()
+		expected := "latency.bucket.le_" + DataDogBound(le)
+		if len(d) != 1 || d[0].Metric != expected {
+			t.Errorf("actual=%v expected=%s\n", d, expected)
+		}
+	}
+	if DataDogBound(math.Inf(1)) != "inf" || DataDogBound(0.5) != "0.5" {
+		t.Errorf("unexpected bound formatting\n")
+	}
+}
+
+func TestDataDogDistribution(t *testing.T) {
+	m := &bucket.Metric{
+		Name:   "latency",
+		Time:   60,
+		Tags:   []string{"region:us"},
+		Values: []float64{1, 2.5},
+	}
+	b, err := json.Marshal(DataDogConvertDistribution(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"metric":"latency","tags":["region:us"],"type":"distribution","points":[[60,[1,2.5]]]}`
+	if string(b) != expected {
+		t.Errorf("actual=%s expected=%s\n", b, expected)
+	}
+	for _, c := range []struct{ series, expected string }{
+		{"https://app.datadoghq.com/api/v1/series", "https://app.datadoghq.com/api/v1/distribution_points"},
+		{"http://localhost:8080/proxy/series", "http://localhost:8080/proxy/distribution_points"},
+	} {
+		actual, err := DataDogDistributionUrl(c.series)
+		if err != nil || actual != c.expected {
+			t.Errorf("actual=%s expected=%s error=%v\n", actual, c.expected, err)
+		}
+	}
+}
@@ -1,13 +1,33 @@
 package metrics
 
-import "github.com/DataDog/l2met/bucket"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
 
-var LibratoUrl = "https://metrics-api.librato.com/v1/metrics"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+)
 
+var LibratoUrl = "https://metrics-api.librato.com/v1/measurements"
+
+// The body of a post to Librato's measurements API.
+// Librato rejects measurements without any tags. Tags
+// set here only apply to measurements that have none.
 type LibratoRequest struct {
-	Gauges []*Librato `json:"gauges"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Measurements []*Librato        `json:"measurements"`
 }
 
+// Sent as the top level tags of every request, so that
+// metrics without a source or tags are still accepted.
+var LibratoDefaultTags = map[string]string{"sender": "l2met"}
+
 type LibratoAttrs struct {
 	Min   int    `json:"display_min"`
 	Units string `json:"display_units_long"`
@@ -19,38 +39,110 @@ type LibratoAttrs struct {
 // with the statistical functions that a bucket offers and
 // the types of data the Librato API accepts (e.g. Librato does-
 // not have support for perc50, perc95, perc99) we need to expand
-// our bucket into a set of Librato(s).
+// our bucket into a set of Librato(s). Complex metrics are sent
+// as summaries with a count and sum, the rest as a single value.
 type Librato struct {
-	Name   string        `json:"name"`
-	Time   int64         `json:"measure_time"`
-	Val    *float64      `json:"value,omitempty"`
-	Count  *int          `json:"count,omitempty"`
-	Sum    *float64      `json:"sum,omitempty"`
-	Max    *float64      `json:"max,omitempty"`
-	Min    *float64      `json:"min,omitempty"`
-	Source string        `json:"source,omitempty"`
-	Auth   string        `json:"-"`
-	Attr   *LibratoAttrs `json:"attributes,omitempty"`
+	Name  string            `json:"name"`
+	Time  int64             `json:"time"`
+	Val   *float64          `json:"value,omitempty"`
+	Count *int              `json:"count,omitempty"`
+	Sum   *float64          `json:"sum,omitempty"`
+	Max   *float64          `json:"max,omitempty"`
+	Min   *float64          `json:"min,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Auth  string            `json:"-"`
+	Attr  *LibratoAttrs     `json:"attributes,omitempty"`
 }
 
+// Characters Librato doesn't accept in tag names and values.
+var (
+	libratoTagName  = regexp.MustCompile(`[^-.:\w]`)
+	libratoTagValue = regexp.MustCompile(`[^-.:\w\\/ ]`)
+)
+
 // Convert a bucket.Metric to a Librato
 func LibratoConvertMetric(m *bucket.Metric) *Librato {
-	attrs := &LibratoAttrs{
-		Min:   m.Attr.Min,
-		Units: m.Attr.Units,
-	}
 	l := &Librato{
-		Name:   m.Name,
-		Time:   m.Time,
-		Val:    m.Val,
-		Count:  m.Count,
-		Sum:    m.Sum,
-		Max:    m.Max,
-		Min:    m.Min,
-		Source: m.Source,
-		Auth:   m.Auth,
-		Attr:   attrs,
+		Name:  m.Name,
+		Time:  m.Time,
+		Val:   m.Val,
+		Count: m.Count,
+		Sum:   m.Sum,
+		Max:   m.Max,
+		Min:   m.Min,
+		Tags:  LibratoTags(m.Source, m.Tags),
+		Auth:  m.Auth,
+	}
+	if m.Le != nil {
+		l.Tags["le"] = DataDogBound(*m.Le)
+	}
+	// Attributes overwrite what is set in Librato's UI,
+	// so they are only sent when the log gave units.
+	if m.Attr != nil && len(m.Attr.Units) > 0 {
+		l.Attr = &LibratoAttrs{
+			Min:   m.Attr.Min,
+			Units: m.Attr.Units,
+		}
 	}
 	return l
+}
 
+// Librato has no sources in its tagged API, so the source
+// becomes a tag. Tags without a value are dropped, and
+// characters Librato rejects are replaced with underscores.
+func LibratoTags(source string, tags []string) map[string]string {
+	res := make(map[string]string)
+	if len(source) > 0 {
+		res["source"] = libratoTagValue.ReplaceAllString(truncate(source, 255), "_")
+	}
+	for _, t := range tags {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			continue
+		}
+		k := libratoTagName.ReplaceAllString(truncate(kv[0], 64), "_")
+		res[k] = libratoTagValue.ReplaceAllString(truncate(kv[1], 255), "_")
+	}
+	return res
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// Builds a request authenticated with the Librato
+// email and api token.
+func LibratoCreateRequest(url, user, token string, body []byte) (*http.Request, error) {
+	b := bytes.NewBuffer(body)
+	req, err := http.NewRequest("POST", url, b)
+	if err != nil {
+		return req, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("User-Agent", "l2met/"+conf.Version)
+	req.Header.Add("Connection", "Keep-Alive")
+	req.SetBasicAuth(user, token)
+	return req, nil
+}
+
+// Librato's error responses list every measurement it
+// rejected, so only the start of one is logged.
+const libratoMaxErrorBody = 1024
+
+func LibratoHandleResponse(resp *http.Response) error {
+	if resp.StatusCode/100 != 2 {
+		var m string
+		s, err := ioutil.ReadAll(io.LimitReader(resp.Body, libratoMaxErrorBody))
+		if err != nil {
+			m = fmt.Sprintf("error=failed-request code=%d", resp.StatusCode)
+		} else {
+			m = fmt.Sprintf("error=failed-request code=%d resp-body=%q",
+				resp.StatusCode, s)
+		}
+		return errors.New(m)
+	}
+	return nil
 }
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/DataDog/l2met/bucket"
+)
+
+func TestLibratoConvertMetric(t *testing.T) {
+	val := float64(1)
+	sum := float64(6)
+	count := 3
+	le := math.Inf(1)
+	cases := []struct {
+		name     string
+		metric   *bucket.Metric
+		expected string
+	}{
+		{
+			"value with source and tags",
+			&bucket.Metric{
+				Name:   "jobs",
+				Time:   60,
+				Val:    &val,
+				Source: "web.1",
+				Tags:   []string{"region:us-east", "canary", "team name:web/api!"},
+				Attr:   &bucket.MetricAttrs{Units: "jobs"},
+			},
+			`{"name":"jobs","time":60,"value":1,"tags":{"region":"us-east","source":"web.1","team_name":"web/api_"},"attributes":{"display_min":0,"display_units_long":"jobs"}}`,
+		},
+		{
+			"summary without units",
+			&bucket.Metric{
+				Name:  "latency",
+				Time:  60,
+				Count: &count,
+				Sum:   &sum,
+				Attr:  &bucket.MetricAttrs{},
+			},
+			`{"name":"latency","time":60,"count":3,"sum":6}`,
+		},
+		{
+			"histogram bound",
+			&bucket.Metric{Name: "size", Time: 60, Val: &val, Le: &le},
+			`{"name":"size","time":60,"value":1,"tags":{"le":"inf"}}`,
+		},
+	}
+	for _, c := range cases {
+		b, err := json.Marshal(LibratoConvertMetric(c.metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.expected {
+			t.Errorf("case=%s\nactual=%s\nexpected=%s\n", c.name, b, c.expected)
+		}
+	}
+}
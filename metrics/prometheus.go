@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/golang/snappy"
+)
+
+var PrometheusUrl = "http://localhost:9090/api/v1/write"
+
+// Mirrors the prometheus.WriteRequest protobuf message.
+type PrometheusRequest struct {
+	Series []*Prometheus
+}
+
+type PrometheusLabel struct {
+	Name  string
+	Value string
+}
+
+type PrometheusSample struct {
+	Value float64
+	// Milliseconds since the epoch.
+	Timestamp int64
+}
+
+// Mirrors the prometheus.TimeSeries protobuf message.
+// The metric name is carried in the __name__ label.
+type Prometheus struct {
+	Labels  []PrometheusLabel
+	Samples []PrometheusSample
+	Auth    string
+}
+
+// Convert a metric into one or more prometheus time series.
+// Complex metrics are expanded the same way as they are for DataDog,
+// using the prometheus suffix conventions (_sum, _count).
+func PrometheusConvertMetric(m *bucket.Metric) []*Prometheus {
+	if m.Le != nil {
+		p := prometheusSeries(m, m.Name+"_bucket", *m.Val)
+		p.Labels = append(p.Labels, PrometheusLabel{"le", PrometheusBound(*m.Le)})
+		sort.Sort(byLabelName(p.Labels))
+		return []*Prometheus{p}
+	}
+	if !m.IsComplex {
+		return []*Prometheus{prometheusSeries(m, m.Name, *m.Val)}
+	}
+	return []*Prometheus{
+		prometheusSeries(m, m.Name+"_min", *m.Min),
+		prometheusSeries(m, m.Name+"_max", *m.Max),
+		prometheusSeries(m, m.Name+"_sum", *m.Sum),
+		prometheusSeries(m, m.Name+"_count", float64(*m.Count)),
+	}
+}
+
+func prometheusSeries(m *bucket.Metric, name string, val float64) *Prometheus {
+	labels := PrometheusLabels(m.Source, m.Tags)
+	labels = append(labels, PrometheusLabel{"__name__", PrometheusName(name)})
+	sort.Sort(byLabelName(labels))
+	return &Prometheus{
+		Labels:  labels,
+		Samples: []PrometheusSample{{val, m.Time * 1000}},
+		Auth:    m.Auth,
+	}
+}
+
+// Maps an l2met source and key:value tags onto prometheus labels.
+// Tags without a value are dropped since labels must have both.
+// The result is sorted by label name.
+func PrometheusLabels(source string, tags []string) []PrometheusLabel {
+	var labels []PrometheusLabel
+	if len(source) > 0 {
+		labels = append(labels, PrometheusLabel{"source", source})
+	}
+	for _, t := range tags {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		labels = append(labels, PrometheusLabel{PrometheusName(kv[0]), kv[1]})
+	}
+	sort.Sort(byLabelName(labels))
+	return labels
+}
+
+// Prometheus only allows [a-zA-Z0-9_:] in metric and label names.
+// Everything else (mostly the dots l2met users like) becomes an
+// underscore.
+func PrometheusName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Formats a histogram bound the way prometheus expects the le label.
+func PrometheusBound(le float64) string {
+	if math.IsInf(le, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(le, 'g', -1, 64)
+}
+
+type byLabelName []PrometheusLabel
+
+func (l byLabelName) Len() int           { return len(l) }
+func (l byLabelName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byLabelName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// Encodes the request using the protobuf wire format.
+// The remote-write schema is small enough that we write
+// the bytes by hand instead of depending on generated code.
+func (r *PrometheusRequest) Marshal() []byte {
+	var buf bytes.Buffer
+	for _, s := range r.Series {
+		var ts bytes.Buffer
+		for _, l := range s.Labels {
+			var lb bytes.Buffer
+			protoString(&lb, 1, l.Name)
+			protoString(&lb, 2, l.Value)
+			protoBytes(&ts, 1, lb.Bytes())
+		}
+		for _, smp := range s.Samples {
+			var sb bytes.Buffer
+			protoDouble(&sb, 1, smp.Value)
+			protoVarint(&sb, 2, uint64(smp.Timestamp))
+			protoBytes(&ts, 2, sb.Bytes())
+		}
+		protoBytes(&buf, 1, ts.Bytes())
+	}
+	return buf.Bytes()
+}
+
+func protoKey(b *bytes.Buffer, field int, wire uint64) {
+	writeUvarint(b, uint64(field)<<3|wire)
+}
+
+func protoVarint(b *bytes.Buffer, field int, v uint64) {
+	protoKey(b, field, 0)
+	writeUvarint(b, v)
+}
+
+func protoDouble(b *bytes.Buffer, field int, v float64) {
+	protoKey(b, field, 1)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	b.Write(tmp[:])
+}
+
+func protoBytes(b *bytes.Buffer, field int, v []byte) {
+	protoKey(b, field, 2)
+	writeUvarint(b, uint64(len(v)))
+	b.Write(v)
+}
+
+func protoString(b *bytes.Buffer, field int, v string) {
+	protoBytes(b, field, []byte(v))
+}
+
+func writeUvarint(b *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	b.Write(tmp[:n])
+}
+
+// Builds a snappy compressed remote-write request. If the credentials
+// contain a colon they are used for basic auth, otherwise a non-empty
+// credential is sent as a bearer token.
+func PrometheusCreateRequest(url, creds string, body []byte) (*http.Request, error) {
+	b := bytes.NewBuffer(snappy.Encode(nil, body))
+	req, err := http.NewRequest("POST", url, b)
+	if err != nil {
+		return req, err
+	}
+	req.Header.Add("Content-Type", "application/x-protobuf")
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Add("User-Agent", "l2met/"+conf.Version)
+	req.Header.Add("Connection", "Keep-Alive")
+	if parts := strings.SplitN(creds, ":", 2); len(parts) == 2 {
+		req.SetBasicAuth(parts[0], parts[1])
+	} else if len(creds) > 0 {
+		req.Header.Add("Authorization", "Bearer "+creds)
+	}
+	return req, nil
+}
+
+func PrometheusHandleResponse(resp *http.Response) error {
+	if resp.StatusCode/100 != 2 {
+		var m string
+		s, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			m = fmt.Sprintf("error=failed-request code=%d", resp.StatusCode)
+		} else {
+			m = fmt.Sprintf("error=failed-request code=%d resp=body=%s",
+				resp.StatusCode, s)
+		}
+		return errors.New(m)
+	}
+	return nil
+}
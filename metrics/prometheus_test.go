@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/DataDog/l2met/bucket"
+)
+
+var promNameTest = []struct {
+	in  string
+	out string
+}{
+	{"db.latency", "db_latency"},
+	{"router:connect", "router:connect"},
+	{"5xx", "_xx"},
+}
+
+func TestPrometheusName(t *testing.T) {
+	for _, ts := range promNameTest {
+		if actual := PrometheusName(ts.in); actual != ts.out {
+			t.Errorf("actual=%s expected=%s\n", actual, ts.out)
+		}
+	}
+}
+
+func TestPrometheusConvertLabels(t *testing.T) {
+	val := float64(1)
+	m := &bucket.Metric{
+		Name:   "db.latency",
+		Time:   1,
+		Val:    &val,
+		Source: "web.1",
+		Tags:   []string{"region:us"},
+	}
+	p := PrometheusConvertMetric(m)
+	if len(p) != 1 {
+		t.Fatalf("actual-len=%d expected-len=1\n", len(p))
+	}
+	expected := []PrometheusLabel{
+		{"__name__", "db_latency"},
+		{"region", "us"},
+		{"source", "web.1"},
+	}
+	for i := range expected {
+		if p[0].Labels[i] != expected[i] {
+			t.Errorf("actual=%v expected=%v\n", p[0].Labels, expected)
+		}
+	}
+	if p[0].Samples[0].Timestamp != 1000 {
+		t.Errorf("actual-ts=%d expected-ts=1000\n", p[0].Samples[0].Timestamp)
+	}
+}
+
+func TestPrometheusMarshal(t *testing.T) {
+	r := &PrometheusRequest{Series: []*Prometheus{{
+		Labels:  []PrometheusLabel{{"__name__", "a"}},
+		Samples: []PrometheusSample{{1, 1000}},
+	}}}
+	expected := []byte{
+		0x0a, 29,
+		0x0a, 13,
+		0x0a, 8, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x12, 1, 'a',
+		0x12, 12,
+		0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f,
+		0x10, 0xe8, 0x07,
+	}
+	if actual := r.Marshal(); !bytes.Equal(actual, expected) {
+		t.Errorf("actual=%x expected=%x\n", actual, expected)
+	}
+}
+
+func TestPrometheusConvertHistogram(t *testing.T) {
+	val := float64(3)
+	le := float64(0.5)
+	p := PrometheusConvertMetric(&bucket.Metric{Name: "latency", Val: &val, Le: &le})
+	expected := []PrometheusLabel{{"__name__", "latency_bucket"}, {"le", "0.5"}}
+	if len(p) != 1 || len(p[0].Labels) != len(expected) {
+		t.Fatalf("actual=%v expected=%v\n", p, expected)
+	}
+	for i := range expected {
+		if p[0].Labels[i] != expected[i] {
+			t.Errorf("actual=%v expected=%v\n", p[0].Labels, expected)
+		}
+	}
+}
@@ -1,15 +1,9 @@
-// The outlet pkg is responsible for taking
-// buckets from the reader, formatting them in the proper format
-// and delivering the formatted datadog metrics to the metric API.
 package outlet
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"net"
 	"net/http"
-	"runtime"
 	"time"
 
 	"github.com/DataDog/l2met/auth"
@@ -17,21 +11,36 @@ import (
 	"github.com/DataDog/l2met/conf"
 	"github.com/DataDog/l2met/metchan"
 	"github.com/DataDog/l2met/metrics"
-	"github.com/DataDog/l2met/reader"
 )
 
+func init() {
+	Register("datadog", func(cfg *conf.D, in <-chan *bucket.Bucket, m *metchan.Channel) Runner {
+		l := NewDataDogOutlet(cfg, in)
+		l.Mchan = m
+		return l
+	})
+}
+
+// Delivers metrics to the DataDog series API. The credential's
+// key is the DataDog api_key, and its endpoint picks the site.
+// With distributions on, measurements also go to the distribution
+// points API next to the series endpoint.
 type DataDogOutlet struct {
-	inbox       chan *bucket.Bucket
-	conversions chan *metrics.DataDog
-	outbox      chan []*metrics.DataDog
-	numOutlets  int
-	rdr         *reader.Reader
-	conn        *http.Client
-	numRetries  int
-	Mchan       *metchan.Channel
+	conn          *http.Client
+	distributions bool
+}
+
+// Sketches are sent as roughly this many values to keep the size
+// of a request bounded. The exact count and sum go as gauges.
+const maxDistributionValues = 1000
+
+// The body Encode builds. Send posts each part to its own API.
+type dataDogBody struct {
+	Series        []*metrics.DataDog             `json:"series,omitempty"`
+	Distributions []*metrics.DataDogDistribution `json:"distributions,omitempty"`
 }
 
-func buildDataDogClient(ttl time.Duration) *http.Client {
+func buildClient(ttl time.Duration) *http.Client {
 	tr := &http.Transport{
 		DisableKeepAlives: false,
 		Dial: func(n, a string) (net.Conn, error) {
@@ -45,119 +54,105 @@ func buildDataDogClient(ttl time.Duration) *http.Client {
 	return &http.Client{Transport: tr}
 }
 
-func NewDataDogOutlet(cfg *conf.D, r *reader.Reader) *DataDogOutlet {
-	l := &DataDogOutlet{
-		conn:        buildDataDogClient(cfg.OutletTtl),
-		inbox:       make(chan *bucket.Bucket, cfg.BufferSize),
-		conversions: make(chan *metrics.DataDog, cfg.BufferSize),
-		outbox:      make(chan []*metrics.DataDog, cfg.BufferSize),
-		numOutlets:  cfg.Concurrency,
-		numRetries:  cfg.OutletRetries,
-		rdr:         r,
-	}
-	return l
+func NewDataDogOutlet(cfg *conf.D, in <-chan *bucket.Bucket) *Engine {
+	return NewEngine(cfg, in, &DataDogOutlet{
+		conn:          buildClient(cfg.OutletTtl),
+		distributions: cfg.DataDogDistributions,
+	})
 }
 
-func (l *DataDogOutlet) Start() {
-	go l.rdr.Start(l.inbox)
-	// Converting is CPU bound as it reads from memory
-	// then computes statistical functions over an array.
-	for i := 0; i < runtime.NumCPU(); i++ {
-		go l.convert()
+func (l *DataDogOutlet) Name() string { return "datadog" }
+
+// Measurements become a distribution when distributions are on.
+// Their min, max, count and sum are still sent as gauges, since
+// a sketch's distribution only approximates the count and sum.
+func (l *DataDogOutlet) Metrics(b *bucket.Bucket) []*bucket.Metric {
+	if !l.distributions || b.Id.Type != "measurement" {
+		return b.Metrics()
+	}
+	if b.Count() == 0 {
+		return nil
 	}
-	go l.groupByUser()
-	for i := 0; i < l.numOutlets; i++ {
-		go l.outlet()
+	return []*bucket.Metric{
+		b.ComplexMetric(),
+		b.DistributionMetric(maxDistributionValues),
 	}
-	go l.Report()
 }
 
-func (l *DataDogOutlet) convert() {
-	for bucket := range l.inbox {
-		for _, metric := range bucket.Metrics() {
-			dd := metrics.DataDogConverter{metric}
-			for _, m := range dd.Convert() {
-				l.conversions <- m
-			}
+func (l *DataDogOutlet) Convert(m *bucket.Metric) []interface{} {
+	if m.Values != nil {
+		return []interface{}{metrics.DataDogConvertDistribution(m)}
+	}
+	dd := metrics.DataDogConverter{m}
+	var points []interface{}
+	for _, p := range dd.Convert() {
+		// The distribution has the measurement's name,
+		// so the sum gauge can't have it too.
+		if l.distributions && m.IsComplex && p.Metric == m.Name {
+			p.Metric += ".sum"
 		}
-		delay := bucket.Id.Delay(time.Now())
-		l.Mchan.Measure("outlet.delay", float64(delay))
+		points = append(points, p)
 	}
+	return points
 }
 
-func (l *DataDogOutlet) groupByUser() {
-	ticker := time.Tick(time.Millisecond * 200)
-	m := make(map[string][]*metrics.DataDog)
-	for {
-		select {
-		case <-ticker:
-			for k, v := range m {
-				if len(v) > 0 {
-					l.outbox <- v
-				}
-				delete(m, k)
-			}
-		case payload := <-l.conversions:
-			usr := payload.Auth
-			if _, present := m[usr]; !present {
-				m[usr] = make([]*metrics.DataDog, 1, 300)
-				m[usr][0] = payload
-			} else {
-				m[usr] = append(m[usr], payload)
-			}
-			if len(m[usr]) == cap(m[usr]) {
-				l.outbox <- m[usr]
-				delete(m, usr)
-			}
+func (l *DataDogOutlet) Encode(points []interface{}) ([]byte, error) {
+	var body dataDogBody
+	for i := range points {
+		switch p := points[i].(type) {
+		case *metrics.DataDog:
+			body.Series = append(body.Series, p)
+		case *metrics.DataDogDistribution:
+			body.Distributions = append(body.Distributions, p)
 		}
 	}
+	return json.Marshal(&body)
 }
 
-func (l *DataDogOutlet) outlet() {
-	for payloads := range l.outbox {
-		if len(payloads) < 1 {
-			fmt.Printf("at=%q\n", "empty-metrics-error")
-			continue
-		}
-		//Since a playload contains all metrics for
-		//a unique datadog api_key, we can extract the user/pass
-		//from any one of the payloads.
-		api_key, err := auth.Decrypt(payloads[0].Auth)
-		if err != nil {
-			fmt.Printf("error=%s\n", err)
-			continue
-		}
+func (l *DataDogOutlet) Auth(c *auth.Credential) error {
+	return nil
+}
 
-		ddReq := &metrics.DataDogRequest{payloads}
-		j, err := json.Marshal(ddReq)
-		if err != nil {
-			fmt.Printf("at=json error=%s key=%s\n", err, api_key)
-			continue
+// Series are posted before distributions. Gauges can be sent
+// twice without harm, so when the distributions fail the whole
+// body can be retried without counting any value twice.
+func (l *DataDogOutlet) Send(c *auth.Credential, body []byte) error {
+	url := metrics.DataDogUrl
+	if len(c.Endpoint) > 0 {
+		url = c.Endpoint
+	}
+	var parts struct {
+		Series        json.RawMessage `json:"series"`
+		Distributions json.RawMessage `json:"distributions"`
+	}
+	if err := json.Unmarshal(body, &parts); err != nil {
+		return err
+	}
+	if len(parts.Series) > 0 {
+		if err := l.post(url, c.Key, seriesBody(parts.Series)); err != nil {
+			return err
 		}
-		if err := l.postWithRetry(api_key, j); err != nil {
-			l.Mchan.Measure("outlet.drop", 1)
+	}
+	if len(parts.Distributions) > 0 {
+		u, err := metrics.DataDogDistributionUrl(url)
+		if err != nil {
+			return err
 		}
+		return l.post(u, c.Key, seriesBody(parts.Distributions))
 	}
+	return nil
 }
 
-func (l *DataDogOutlet) postWithRetry(api_key string, body []byte) error {
-	for i := 0; i <= l.numRetries; i++ {
-		if err := l.post(api_key, body); err != nil {
-			fmt.Printf("measure.datadog.error key=%s msg=%s attempt=%d\n", api_key, err, i)
-			if i == l.numRetries {
-				return err
-			}
-			continue
-		}
-		return nil
-	}
-	//Should not be possible.
-	return errors.New("Unable to post.")
+// Both APIs take the points in a series array.
+func seriesBody(points json.RawMessage) []byte {
+	return []byte(`{"series":` + string(points) + `}`)
 }
 
-func (l *DataDogOutlet) post(api_key string, body []byte) error {
-	defer l.Mchan.Time("outlet.post", time.Now())
-	req, err := metrics.DataDogCreateRequest(metrics.DataDogUrl, api_key, body)
+func (l *DataDogOutlet) post(url, apiKey string, body []byte) error {
+	req, err := metrics.DataDogCreateRequest(url, apiKey, body)
+	if err != nil {
+		return err
+	}
 	resp, err := l.conn.Do(req)
 	if err != nil {
 		return err
@@ -165,14 +160,3 @@ func (l *DataDogOutlet) post(api_key string, body []byte) error {
 	defer resp.Body.Close()
 	return metrics.DataDogHandleResponse(resp, body)
 }
-
-// Keep an eye on the lenghts of our buffers.
-// If they are maxed out, something is going wrong.
-func (l *DataDogOutlet) Report() {
-	for _ = range time.Tick(time.Second) {
-		pre := "datadog-outlet."
-		l.Mchan.Measure(pre+"inbox", float64(len(l.inbox)))
-		l.Mchan.Measure(pre+"conversion", float64(len(l.conversions)))
-		l.Mchan.Measure(pre+"outbox", float64(len(l.outbox)))
-	}
-}
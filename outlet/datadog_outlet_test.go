@@ -0,0 +1,118 @@
+package outlet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/metrics"
+)
+
+func TestDataDogOutletDistributions(t *testing.T) {
+	setTestKey(t)
+	rs := new(recordingServer)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	cfg.DataDogDistributions = true
+	creds := `{"backend": "datadog", "endpoint": "` + srv.URL + `/api/v1/series", "key": "abc"}`
+	in := make(chan *bucket.Bucket, 2)
+	for _, c := range []struct {
+		name, typ string
+		vals      []float64
+	}{
+		{"latency", "measurement", []float64{3, 1, 2}},
+		{"jobs", "counter", []float64{4}},
+	} {
+		id := &bucket.Id{
+			Time:       time.Unix(60, 0),
+			Resolution: time.Minute,
+			Auth:       encrypt(t, creds),
+			Name:       c.name,
+			Type:       c.typ,
+		}
+		b := &bucket.Bucket{Id: id}
+		for _, v := range c.vals {
+			b.Append(v)
+		}
+		in <- b
+	}
+	close(in)
+	l := NewDataDogOutlet(cfg, in)
+	l.Mchan = new(metchan.Channel)
+	l.Start(context.Background())
+	l.Stop()
+
+	series := rs.body("/api/v1/series")
+	if !strings.Contains(series, `"metric":"jobs"`) || !strings.Contains(series, `"metric":"latency.sum"`) ||
+		strings.Contains(series, `"metric":"latency"`) {
+		t.Errorf("actual-series=%s\n", series)
+	}
+	expected := `{"series":[{"metric":"latency","type":"distribution","points":[[60,[3,1,2]]]}]}`
+	if actual := rs.body("/api/v1/distribution_points"); actual != expected {
+		t.Errorf("actual=%s expected=%s\n", actual, expected)
+	}
+}
+
+func TestDataDogOutletDistributionTotals(t *testing.T) {
+	setTestKey(t)
+	rs := new(recordingServer)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	cfg.DataDogDistributions = true
+	creds := `{"backend": "datadog", "endpoint": "` + srv.URL + `/api/v1/series", "key": "abc"}`
+	id := &bucket.Id{
+		Time:       time.Unix(60, 0),
+		Resolution: time.Minute,
+		Auth:       encrypt(t, creds),
+		Name:       "latency",
+		Type:       "measurement",
+	}
+	// Far more values than a distribution carries, so they are sketched.
+	const n = 5000
+	b := &bucket.Bucket{Id: id}
+	for i := 1; i <= n; i++ {
+		b.Append(float64(i))
+	}
+	in := make(chan *bucket.Bucket, 1)
+	in <- b
+	close(in)
+	l := NewDataDogOutlet(cfg, in)
+	l.Mchan = new(metchan.Channel)
+	l.Start(context.Background())
+	l.Stop()
+
+	var series metrics.DataDogRequest
+	if err := json.Unmarshal([]byte(rs.body("/api/v1/series")), &series); err != nil {
+		t.Fatal(err)
+	}
+	gauges := make(map[string]string)
+	for _, m := range series.Series {
+		body, _ := json.Marshal(m)
+		gauges[m.Metric] = string(body)
+	}
+	for name, expected := range map[string]string{
+		"latency.count": "[[60,5000]]",
+		"latency.sum":   "[[60,12502500]]",
+		"latency.min":   "[[60,1]]",
+		"latency.max":   "[[60,5000]]",
+	} {
+		if !strings.Contains(gauges[name], `"points":`+expected) {
+			t.Errorf("name=%s actual=%s expected-points=%s\n", name, gauges[name], expected)
+		}
+	}
+	if !strings.Contains(rs.body("/api/v1/distribution_points"), `"metric":"latency"`) {
+		t.Errorf("expected a latency distribution\n")
+	}
+}
@@ -0,0 +1,250 @@
+package outlet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+// A point and the encrypted credential of its bucket.
+type conversion struct {
+	auth  string
+	point interface{}
+}
+
+// Points sharing an encrypted credential.
+type batch struct {
+	auth   string
+	points []interface{}
+}
+
+// Runs an Outlet: buckets from the inbox are converted,
+// grouped into batches by credential, encoded and sent.
+// Sends are retried immediately up to the configured number
+// of times and then handed to a RetryQueue.
+type Engine struct {
+	out         Outlet
+	inbox       <-chan *bucket.Bucket
+	conversions chan conversion
+	outbox      chan batch
+	numOutlets  int
+	batchSize   int
+	batchWait   time.Duration
+	// Read and written atomically so Reload can change it.
+	numRetries int64
+	// Batches that failed every immediate retry.
+	retries *RetryQueue
+	creds   auth.Cache
+	Mchan   *metchan.Channel
+	// Conversions are closed once the convert routines
+	// finish. Stop waits for the remaining routines.
+	converting, running sync.WaitGroup
+	cancel              context.CancelFunc
+}
+
+func NewEngine(cfg *conf.D, in <-chan *bucket.Bucket, o Outlet) *Engine {
+	l := &Engine{
+		out:         o,
+		inbox:       in,
+		conversions: make(chan conversion, cfg.BufferSize),
+		outbox:      make(chan batch, cfg.BufferSize),
+		numOutlets:  cfg.Concurrency,
+		batchSize:   cfg.OutletBatchSize,
+		batchWait:   cfg.OutletBatchWait,
+		numRetries:  int64(cfg.OutletRetries),
+	}
+	l.retries = NewRetryQueue(o.Name(), cfg, l.sendEncrypted)
+	return l
+}
+
+// Runs until ctx is done or Stop is called.
+func (l *Engine) Start(ctx context.Context) {
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.retries.Mchan = l.Mchan
+	l.retries.Start(ctx, time.Second)
+	// Converting is CPU bound as it reads from memory
+	// then computes statistical functions over an array.
+	for i := 0; i < runtime.NumCPU(); i++ {
+		l.converting.Add(1)
+		go l.convert()
+	}
+	go func() {
+		l.converting.Wait()
+		close(l.conversions)
+	}()
+	l.running.Add(2 + l.numOutlets)
+	go l.groupByUser()
+	for i := 0; i < l.numOutlets; i++ {
+		go l.outlet()
+	}
+	go l.Report(ctx)
+}
+
+// Returns once the inbox has been closed and the buckets in it
+// have been converted, grouped and posted, so the reader has to
+// be stopped first. Batches waiting to be retried are left in
+// the retry queue.
+func (l *Engine) Stop() {
+	l.cancel()
+	l.running.Wait()
+	l.retries.Stop()
+}
+
+// Applies the retry setting from cfg.
+// Buffered buckets are kept.
+func (l *Engine) Reload(cfg *conf.D) {
+	atomic.StoreInt64(&l.numRetries, int64(cfg.OutletRetries))
+}
+
+func (l *Engine) convert() {
+	defer l.converting.Done()
+	for bucket := range l.inbox {
+		// Bad credentials are dropped when the batch is sent.
+		c, _ := l.creds.Get(bucket.Id.Auth)
+		for _, metric := range l.metrics(bucket) {
+			if c != nil {
+				metric.Tags = append(metric.Tags, c.Tags...)
+			}
+			for _, p := range l.out.Convert(metric) {
+				l.conversions <- conversion{bucket.Id.Auth, p}
+			}
+		}
+		delay := bucket.Id.Delay(time.Now())
+		l.Mchan.Measure("outlet.delay", float64(delay))
+	}
+}
+
+func (l *Engine) metrics(b *bucket.Bucket) []*bucket.Metric {
+	if bc, ok := l.out.(BucketConverter); ok {
+		return bc.Metrics(b)
+	}
+	return b.Metrics()
+}
+
+// Batches points by credential. A batch is sent when it
+// is full or when it has waited for batchWait.
+func (l *Engine) groupByUser() {
+	defer l.running.Done()
+	ticker := time.NewTicker(l.batchWait)
+	defer ticker.Stop()
+	m := make(map[string][]interface{})
+	flush := func() {
+		for k, v := range m {
+			if len(v) > 0 {
+				l.outbox <- batch{k, v}
+			}
+			delete(m, k)
+		}
+	}
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case c, ok := <-l.conversions:
+			if !ok {
+				flush()
+				close(l.outbox)
+				return
+			}
+			if _, present := m[c.auth]; !present {
+				m[c.auth] = make([]interface{}, 0, l.batchSize)
+			}
+			m[c.auth] = append(m[c.auth], c.point)
+			if len(m[c.auth]) >= l.batchSize {
+				l.outbox <- batch{c.auth, m[c.auth]}
+				delete(m, c.auth)
+			}
+		}
+	}
+}
+
+func (l *Engine) outlet() {
+	defer l.running.Done()
+	for b := range l.outbox {
+		c, err := l.auth(b.auth)
+		if err != nil {
+			fmt.Printf("error=%s outlet=%s\n", err, l.out.Name())
+			l.Mchan.Measure("outlet.drop", 1)
+			continue
+		}
+		body, err := l.out.Encode(b.points)
+		if err != nil {
+			fmt.Printf("at=encode error=%s outlet=%s\n", err, l.out.Name())
+			l.Mchan.Measure("outlet.drop", 1)
+			continue
+		}
+		if err := l.postWithRetry(c, body); err != nil {
+			l.retries.Add(b.auth, body)
+		}
+	}
+}
+
+// Decrypts the credential and checks it with the outlet.
+func (l *Engine) auth(encrypted string) (*auth.Credential, error) {
+	c, err := l.creds.Get(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.out.Auth(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (l *Engine) postWithRetry(c *auth.Credential, body []byte) error {
+	retries := int(atomic.LoadInt64(&l.numRetries))
+	for i := 0; i <= retries; i++ {
+		if err := l.post(c, body); err != nil {
+			fmt.Printf("measure.%s.error msg=%s attempt=%d\n", l.out.Name(), err, i)
+			if i == retries {
+				return err
+			}
+			continue
+		}
+		return nil
+	}
+	//Should not be possible.
+	return errors.New("Unable to post.")
+}
+
+// Used by the retry queue, which only keeps encrypted credentials.
+func (l *Engine) sendEncrypted(encrypted string, body []byte) error {
+	c, err := l.auth(encrypted)
+	if err != nil {
+		return err
+	}
+	return l.post(c, body)
+}
+
+func (l *Engine) post(c *auth.Credential, body []byte) error {
+	defer l.Mchan.Time("outlet.post", time.Now())
+	return l.out.Send(c, body)
+}
+
+// Keep an eye on the lenghts of our buffers.
+// If they are maxed out, something is going wrong.
+func (l *Engine) Report(ctx context.Context) {
+	defer l.running.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		pre := l.out.Name() + "-outlet."
+		l.Mchan.Measure(pre+"inbox", float64(len(l.inbox)))
+		l.Mchan.Measure(pre+"conversion", float64(len(l.conversions)))
+		l.Mchan.Measure(pre+"outbox", float64(len(l.outbox)))
+	}
+}
@@ -0,0 +1,235 @@
+package outlet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/reader"
+	"github.com/DataDog/l2met/store"
+	"github.com/kr/fernet"
+)
+
+// Records the batches it is asked to send.
+type testBackend struct {
+	sync.Mutex
+	fail    bool
+	batches []string
+}
+
+func (o *testBackend) Name() string { return "test" }
+
+func (o *testBackend) Convert(m *bucket.Metric) []interface{} {
+	if len(m.Tags) > 0 {
+		return []interface{}{m.Name + "#" + strings.Join(m.Tags, ";")}
+	}
+	return []interface{}{m.Name}
+}
+
+func (o *testBackend) Encode(points []interface{}) ([]byte, error) {
+	names := make([]string, len(points))
+	for i := range points {
+		names[i] = points[i].(string)
+	}
+	sort.Strings(names)
+	return []byte(strings.Join(names, ",")), nil
+}
+
+func (o *testBackend) Auth(c *auth.Credential) error {
+	if c.Key == "bad" {
+		return errors.New("bad creds")
+	}
+	return nil
+}
+
+func (o *testBackend) Send(c *auth.Credential, body []byte) error {
+	o.Lock()
+	defer o.Unlock()
+	if o.fail {
+		return errors.New("unavailable")
+	}
+	o.batches = append(o.batches, c.Key+" "+string(body))
+	return nil
+}
+
+// Installs a fresh key for encrypt and the outlets to use.
+func setTestKey(t *testing.T) {
+	var k fernet.Key
+	if err := auth.SetKeys([]string{k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Stands in for a backend's API. Records every request and its
+// body, and fails them with status when it is set.
+type recordingServer struct {
+	sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (s *recordingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	b, _ := ioutil.ReadAll(r.Body)
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, b)
+	if s.status != 0 {
+		http.Error(w, `{"errors":{"params":{"name":["is invalid"]}}}`, s.status)
+	}
+}
+
+// Every body posted to path, in order.
+func (s *recordingServer) body(path string) string {
+	s.Lock()
+	defer s.Unlock()
+	var res string
+	for i, r := range s.requests {
+		if r.URL.Path == path {
+			res += string(s.bodies[i])
+		}
+	}
+	return res
+}
+
+func encrypt(t *testing.T, creds string) string {
+	tok, err := auth.EncryptAndSign([]byte(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(tok)
+}
+
+func TestEngineBatchesByCredential(t *testing.T) {
+	setTestKey(t)
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	cfg.OutletBatchSize = 2
+	st := store.NewMemStore()
+	ts := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	// Batches are keyed by the encrypted credential, and a drain
+	// always sends the same one, so each is encrypted only once.
+	tokens := make(map[string]string)
+	for _, creds := range []string{"a", "b", "bad"} {
+		tokens[creds] = encrypt(t, creds)
+	}
+	for _, c := range []struct{ creds, name string }{
+		{"a", "x"}, {"a", "y"}, {"a", "z"}, {"b", "x"}, {"bad", "x"},
+	} {
+		id := &bucket.Id{
+			Time:       ts,
+			Resolution: time.Minute,
+			ReadyAt:    ts.Add(time.Minute),
+			Auth:       tokens[c.creds],
+			Name:       c.name,
+			Type:       "counter",
+		}
+		st.Put(&bucket.Bucket{Id: id, Vals: []float64{1}, Sum: 1})
+	}
+
+	o := new(testBackend)
+	rdr := reader.New(cfg, st)
+	l := NewEngine(cfg, rdr.Subscribe("test", cfg.BufferSize), o)
+	l.Mchan = new(metchan.Channel)
+	rdr.Start(context.Background())
+	l.Start(context.Background())
+	rdr.Stop()
+	l.Stop()
+
+	// Only the first batch for a is full, so the other two are
+	// sent by the final flush. Buckets arrive in no particular
+	// order, so which of a's names share a batch varies.
+	var sizes, names []string
+	for _, b := range o.batches {
+		parts := strings.SplitN(b, " ", 2)
+		sizes = append(sizes, fmt.Sprintf("%s%d", parts[0], strings.Count(parts[1], ",")+1))
+		for _, name := range strings.Split(parts[1], ",") {
+			names = append(names, parts[0]+"."+name)
+		}
+	}
+	sort.Strings(sizes)
+	sort.Strings(names)
+	expected := "[a1 a2 b1] [a.x a.y a.z b.x]"
+	if actual := fmt.Sprint(sizes, " ", names); actual != expected {
+		t.Errorf("actual=%s expected=%s\n", actual, expected)
+	}
+}
+
+func TestEngineAddsCredentialTags(t *testing.T) {
+	setTestKey(t)
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	in := make(chan *bucket.Bucket, 1)
+	id := &bucket.Id{
+		Time:       time.Now().Truncate(time.Minute),
+		Resolution: time.Minute,
+		Auth:       encrypt(t, `{"backend": "test", "key": "a", "tags": ["team:web"]}`),
+		Name:       "x",
+		Tags:       "region:us",
+		Type:       "counter",
+	}
+	in <- &bucket.Bucket{Id: id, Vals: []float64{1}, Sum: 1}
+	close(in)
+
+	o := new(testBackend)
+	l := NewEngine(cfg, in, o)
+	l.Mchan = new(metchan.Channel)
+	l.Start(context.Background())
+	l.Stop()
+
+	expected := "[a x#region:us;team:web]"
+	if actual := "[" + strings.Join(o.batches, " ") + "]"; actual != expected {
+		t.Errorf("actual=%s expected=%s\n", actual, expected)
+	}
+}
+
+func TestEngineQueuesFailedBatches(t *testing.T) {
+	setTestKey(t)
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	cfg.OutletRetries = 1
+	o := &testBackend{fail: true}
+	l := NewEngine(cfg, nil, o)
+	l.outbox = make(chan batch, 1)
+	l.outbox <- batch{encrypt(t, "a"), []interface{}{"x"}}
+	close(l.outbox)
+	l.running.Add(1)
+	l.outlet()
+
+	if n, _ := l.retries.Depth(); n != 1 {
+		t.Fatalf("actual-depth=%d expected-depth=1\n", n)
+	}
+	o.fail = false
+	l.retries.retry(time.Now().Add(time.Minute))
+	if len(o.batches) != 1 || o.batches[0] != "a x" {
+		t.Errorf("actual=%v expected=[a x]\n", o.batches)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	names := strings.Join(Names(), ",")
+	if names != "datadog,librato,prometheus,prometheus-scrape" {
+		t.Errorf("actual=%s\n", names)
+	}
+	cfg := conf.Defaults()
+	for _, name := range Names() {
+		if _, err := New(name, cfg, nil, nil); err != nil {
+			t.Errorf("name=%s error=%s\n", name, err)
+		}
+	}
+	if _, err := New("graphite", cfg, nil, nil); err == nil {
+		t.Errorf("expected error for unknown outlet\n")
+	}
+}
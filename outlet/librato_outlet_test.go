@@ -0,0 +1,130 @@
+package outlet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/metrics"
+)
+
+// Decodes a request recorded by a recordingServer.
+func libratoBody(t *testing.T, b []byte) metrics.LibratoRequest {
+	var body metrics.LibratoRequest
+	if err := json.Unmarshal(b, &body); err != nil {
+		t.Fatalf("body=%s error=%s\n", b, err)
+	}
+	return body
+}
+
+func TestLibratoOutletPosts(t *testing.T) {
+	setTestKey(t)
+	rs := new(recordingServer)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	in := make(chan *bucket.Bucket, 1)
+	creds := `{"backend": "librato", "endpoint": "` + srv.URL + `/v1/measurements",
+		"key": "e@foo.com:abc123", "tags": ["team:web"]}`
+	id := &bucket.Id{
+		Time:       time.Unix(60, 0),
+		Resolution: time.Minute,
+		Auth:       encrypt(t, creds),
+		Name:       "jobs",
+		Source:     "web.1",
+		Units:      "jobs",
+		Type:       "counter",
+	}
+	in <- &bucket.Bucket{Id: id, Vals: []float64{2}, Sum: 2}
+	close(in)
+	l := NewLibratoOutlet(cfg, in)
+	l.Mchan = new(metchan.Channel)
+	l.Start(context.Background())
+	l.Stop()
+
+	if len(rs.requests) != 1 {
+		t.Fatalf("actual-requests=%d expected-requests=1\n", len(rs.requests))
+	}
+	r := rs.requests[0]
+	if u, p, _ := r.BasicAuth(); u != "e@foo.com" || p != "abc123" {
+		t.Errorf("actual-auth=%s:%s\n", u, p)
+	}
+	if r.URL.Path != "/v1/measurements" || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("actual-path=%s actual-type=%s\n", r.URL.Path, r.Header.Get("Content-Type"))
+	}
+	ms := libratoBody(t, rs.bodies[0]).Measurements
+	if len(ms) != 1 {
+		t.Fatalf("actual-measurements=%d expected-measurements=1\n", len(ms))
+	}
+	m := ms[0]
+	if m.Name != "jobs" || m.Time != 60 || m.Val == nil || *m.Val != 2 {
+		t.Errorf("actual=%+v\n", m)
+	}
+	if m.Tags["source"] != "web.1" || m.Tags["team"] != "web" {
+		t.Errorf("actual-tags=%v\n", m.Tags)
+	}
+	if m.Attr == nil || m.Attr.Units != "jobs" {
+		t.Errorf("actual-attributes=%+v expected units=jobs\n", m.Attr)
+	}
+}
+
+func TestLibratoOutletTagsEveryMeasurement(t *testing.T) {
+	setTestKey(t)
+	rs := new(recordingServer)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	cfg := conf.Defaults()
+	cfg.Concurrency = 1
+	in := make(chan *bucket.Bucket, 1)
+	creds := `{"backend": "librato", "endpoint": "` + srv.URL + `", "key": "e@foo.com:abc123"}`
+	// Neither a source nor tags, so the measurement has no tags of its own.
+	id := &bucket.Id{
+		Time:       time.Unix(60, 0),
+		Resolution: time.Minute,
+		Auth:       encrypt(t, creds),
+		Name:       "jobs",
+		Type:       "counter",
+	}
+	in <- &bucket.Bucket{Id: id, Vals: []float64{2}, Sum: 2}
+	close(in)
+	l := NewLibratoOutlet(cfg, in)
+	l.Mchan = new(metchan.Channel)
+	l.Start(context.Background())
+	l.Stop()
+
+	if len(rs.bodies) != 1 {
+		t.Fatalf("actual-requests=%d expected-requests=1\n", len(rs.bodies))
+	}
+	body := libratoBody(t, rs.bodies[0])
+	if len(body.Measurements) != 1 {
+		t.Fatalf("actual-measurements=%d expected-measurements=1\n", len(body.Measurements))
+	}
+	if len(body.Measurements[0].Tags) == 0 && len(body.Tags) == 0 {
+		t.Errorf("measurement has no tags and the request has no default tags\n")
+	}
+}
+
+func TestLibratoOutletReportsFailures(t *testing.T) {
+	rs := &recordingServer{status: 400}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+	o := &LibratoOutlet{conn: buildClient(time.Second)}
+	c := &auth.Credential{Endpoint: srv.URL, Key: "e@foo.com:abc123"}
+	err := o.Send(c, []byte(`{"measurements":[]}`))
+	if err == nil || !strings.Contains(err.Error(), "code=400") {
+		t.Errorf("actual-err=%v expected code=400\n", err)
+	}
+	if err := o.Auth(&auth.Credential{Key: "abc123"}); err == nil {
+		t.Errorf("expected error for a key without a token\n")
+	}
+}
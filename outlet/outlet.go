@@ -0,0 +1,92 @@
+// The outlet pkg is responsible for taking buckets from the
+// reader, formatting them for a metrics backend and delivering
+// them. Backends implement Outlet and share the Engine, which
+// batches by credential, retries and reports on its buffers.
+package outlet
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+// A metrics backend. Points are the backend's own
+// representation of a metric, e.g. *metrics.DataDog.
+type Outlet interface {
+	// Used in logs, internal metrics and the retry directory.
+	Name() string
+	// Converts a metric into the points the backend sends.
+	Convert(m *bucket.Metric) []interface{}
+	// Encodes points sharing a credential into a request body.
+	Encode(points []interface{}) ([]byte, error)
+	// Checks that the backend can use a decrypted credential.
+	// Batches whose credential is rejected are dropped.
+	Auth(c *auth.Credential) error
+	// Posts a body to the credential's endpoint, or
+	// the backend's default when it has none.
+	Send(c *auth.Credential, body []byte) error
+}
+
+// Implemented by outlets that turn some buckets into other
+// metrics than bucket.Metrics does, e.g. to send raw values.
+type BucketConverter interface {
+	Metrics(b *bucket.Bucket) []*bucket.Metric
+}
+
+// What main runs for each enabled outlet.
+type Runner interface {
+	Start(ctx context.Context)
+	Stop()
+	Reload(cfg *conf.D)
+}
+
+// Builds a Runner from the outlet's config. The Runner reads
+// buckets from in until it is closed, usually a subscription
+// to the reader shared by all outlets.
+type Factory func(cfg *conf.D, in <-chan *bucket.Bucket, m *metchan.Channel) Runner
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Factory)
+)
+
+// Makes an outlet available to New under name. The name is the
+// one used in the outlets section of the config file and the
+// backend that credentials use to route to the outlet.
+func Register(name string, f Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("outlet: Register called twice for " + name)
+	}
+	registry[name] = f
+}
+
+// The names of the registered outlets, sorted.
+func Names() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builds the named outlet. It still needs to be started.
+func New(name string, cfg *conf.D, in <-chan *bucket.Bucket, m *metchan.Channel) (Runner, error) {
+	registryLock.Lock()
+	f, ok := registry[name]
+	registryLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("outlet: unknown outlet %q", name)
+	}
+	return f(cfg, in, m), nil
+}
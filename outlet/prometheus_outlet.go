@@ -0,0 +1,70 @@
+package outlet
+
+import (
+	"net/http"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/metrics"
+)
+
+func init() {
+	Register("prometheus", func(cfg *conf.D, in <-chan *bucket.Bucket, m *metchan.Channel) Runner {
+		l := NewPrometheusOutlet(cfg, in)
+		l.Mchan = m
+		return l
+	})
+}
+
+// Delivers metrics to a prometheus remote-write endpoint.
+// Keys of the form user:password are sent with basic
+// auth and any other key as a bearer token.
+type PrometheusOutlet struct {
+	conn *http.Client
+}
+
+func NewPrometheusOutlet(cfg *conf.D, in <-chan *bucket.Bucket) *Engine {
+	return NewEngine(cfg, in, &PrometheusOutlet{conn: buildClient(cfg.OutletTtl)})
+}
+
+func (l *PrometheusOutlet) Name() string { return "prometheus" }
+
+func (l *PrometheusOutlet) Convert(m *bucket.Metric) []interface{} {
+	var points []interface{}
+	for _, p := range metrics.PrometheusConvertMetric(m) {
+		points = append(points, p)
+	}
+	return points
+}
+
+func (l *PrometheusOutlet) Encode(points []interface{}) ([]byte, error) {
+	series := make([]*metrics.Prometheus, len(points))
+	for i := range points {
+		series[i] = points[i].(*metrics.Prometheus)
+	}
+	promReq := &metrics.PrometheusRequest{Series: series}
+	return promReq.Marshal(), nil
+}
+
+func (l *PrometheusOutlet) Auth(c *auth.Credential) error {
+	return nil
+}
+
+func (l *PrometheusOutlet) Send(c *auth.Credential, body []byte) error {
+	url := metrics.PrometheusUrl
+	if len(c.Endpoint) > 0 {
+		url = c.Endpoint
+	}
+	req, err := metrics.PrometheusCreateRequest(url, c.Key, body)
+	if err != nil {
+		return err
+	}
+	resp, err := l.conn.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return metrics.PrometheusHandleResponse(resp)
+}
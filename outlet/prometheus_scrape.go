@@ -0,0 +1,323 @@
+package outlet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/metrics"
+)
+
+// Number of resolutions a series may go without a new
+// bucket before it is removed from the scrape output.
+const scrapeExpiry = 5
+
+type scrapeKey struct {
+	Name   string
+	Type   string
+	Source string
+	Tags   string
+}
+
+// The latest state of a single series. Counters and the
+// sum & count of summaries are accumulated across buckets
+// since prometheus expects them to be monotonic.
+type scrapeSeries struct {
+	key       scrapeKey
+	last      time.Time
+	expiry    time.Duration
+	val       float64
+	count     int
+	quantiles []float64
+	// Percentiles (0-100] matching quantiles.
+	percentiles []float64
+	// Histogram bounds and cumulative counts per bound.
+	bounds  string
+	buckets []float64
+}
+
+// Keeps the latest finished buckets read from the store and
+// serves them in the prometheus text exposition format.
+// Series are partitioned by credential; a scrape must present
+// the same encrypted credential that was used to drain the logs.
+type PrometheusScrapeOutlet struct {
+	sync.Mutex
+	inbox  <-chan *bucket.Bucket
+	series map[string]map[scrapeKey]*scrapeSeries
+	creds  auth.Cache
+	Mchan  *metchan.Channel
+	cancel context.CancelFunc
+	// Tracks the accept and report routines.
+	running sync.WaitGroup
+}
+
+func init() {
+	Register("prometheus-scrape", func(cfg *conf.D, in <-chan *bucket.Bucket, m *metchan.Channel) Runner {
+		l := NewPrometheusScrapeOutlet(cfg, in)
+		l.Mchan = m
+		return l
+	})
+}
+
+func NewPrometheusScrapeOutlet(cfg *conf.D, in <-chan *bucket.Bucket) *PrometheusScrapeOutlet {
+	return &PrometheusScrapeOutlet{
+		inbox:  in,
+		series: make(map[string]map[scrapeKey]*scrapeSeries),
+	}
+}
+
+// Runs until ctx is done or Stop is called.
+func (l *PrometheusScrapeOutlet) Start(ctx context.Context) {
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.running.Add(2)
+	go l.accept()
+	go l.Report(ctx)
+}
+
+// Returns once the inbox has been closed and the buckets
+// in it have been added to the served series.
+func (l *PrometheusScrapeOutlet) Stop() {
+	l.cancel()
+	l.running.Wait()
+}
+
+// Nothing in cfg applies to the scrape outlet while running.
+func (l *PrometheusScrapeOutlet) Reload(cfg *conf.D) {}
+
+func (l *PrometheusScrapeOutlet) accept() {
+	defer l.running.Done()
+	for b := range l.inbox {
+		l.add(b)
+		delay := b.Id.Delay(time.Now())
+		l.Mchan.Measure("outlet.delay", float64(delay))
+	}
+}
+
+func (l *PrometheusScrapeOutlet) add(b *bucket.Bucket) {
+	l.Lock()
+	defer l.Unlock()
+	user, err := l.decrypt(b.Id.Auth)
+	if err != nil {
+		fmt.Printf("error=%s\n", err)
+		return
+	}
+	m, ok := l.series[user]
+	if !ok {
+		m = make(map[scrapeKey]*scrapeSeries)
+		l.series[user] = m
+	}
+	k := scrapeKey{b.Id.Name, b.Id.Type, b.Id.Source, b.Id.Tags}
+	s, ok := m[k]
+	if !ok {
+		s = &scrapeSeries{key: k}
+		m[k] = s
+	}
+	s.last = time.Now()
+	s.expiry = b.Id.Resolution * scrapeExpiry
+	switch b.Id.Type {
+	case "counter":
+		s.val += b.Sum
+	case "sample":
+		s.val = b.Last()
+	case "unique":
+		s.val = float64(b.Unique())
+	case "measurement":
+		s.val += b.Sum
+		s.count += b.Count()
+		s.percentiles = b.Id.PercentileList()
+		s.quantiles = make([]float64, len(s.percentiles))
+		for i, p := range s.percentiles {
+			s.quantiles[i] = b.Quantile(p / 100)
+		}
+	case "histogram":
+		// Changing the bounds invalidates the accumulated counts.
+		if s.bounds != b.Id.Bounds {
+			s.bounds = b.Id.Bounds
+			s.buckets = nil
+			s.val = 0
+			s.count = 0
+		}
+		counts := b.Cumulative()
+		if s.buckets == nil {
+			s.buckets = make([]float64, len(counts))
+		}
+		for i := range counts {
+			s.buckets[i] += float64(counts[i])
+		}
+		s.val += b.Sum
+		s.count += b.Count()
+	}
+}
+
+// Returns the key of the credential that series are
+// partitioned by.
+func (l *PrometheusScrapeOutlet) decrypt(a string) (string, error) {
+	c, err := l.creds.Get(a)
+	if err != nil {
+		return "", err
+	}
+	return c.Key, nil
+}
+
+// Drops the expired series of every user, including
+// users nobody scrapes. Must be called with the lock held.
+func (l *PrometheusScrapeOutlet) prune(now time.Time) {
+	for user, m := range l.series {
+		for k, s := range m {
+			if now.Sub(s.last) > s.expiry {
+				delete(m, k)
+			}
+		}
+		if len(m) == 0 {
+			delete(l.series, user)
+		}
+	}
+}
+
+func (l *PrometheusScrapeOutlet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer l.Mchan.Time("outlet.scrape", time.Now())
+	authLine := r.Header.Get("Authorization")
+	parseRes, err := auth.Parse(authLine)
+	if err != nil {
+		http.Error(w, "Fail: Parse auth.", 400)
+		return
+	}
+	l.Lock()
+	user, err := l.decrypt(parseRes)
+	if err != nil {
+		l.Unlock()
+		http.Error(w, "Authentication failed.", 401)
+		return
+	}
+	body := l.render(user, time.Now())
+	l.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(body)
+}
+
+// Must be called with the lock held.
+func (l *PrometheusScrapeOutlet) render(user string, now time.Time) []byte {
+	m := l.series[user]
+	series := make([]*scrapeSeries, 0, len(m))
+	for k, s := range m {
+		if now.Sub(s.last) > s.expiry {
+			delete(m, k)
+			continue
+		}
+		series = append(series, s)
+	}
+	sort.Sort(byScrapeKey(series))
+	var buf bytes.Buffer
+	prevName := ""
+	for _, s := range series {
+		name := metrics.PrometheusName(s.key.Name)
+		labels := metrics.PrometheusLabels(s.key.Source,
+			(&bucket.Id{Tags: s.key.Tags}).TagList())
+		if name != prevName {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", name, scrapeType(s.key.Type))
+			prevName = name
+		}
+		switch s.key.Type {
+		case "measurement":
+			for i, p := range s.percentiles {
+				q := strconv.FormatFloat(p/100, 'g', -1, 64)
+				ql := append(labels, metrics.PrometheusLabel{Name: "quantile", Value: q})
+				writeScrapeLine(&buf, name, ql, s.quantiles[i])
+			}
+			writeScrapeLine(&buf, name+"_sum", labels, s.val)
+			writeScrapeLine(&buf, name+"_count", labels, float64(s.count))
+		case "histogram":
+			bounds := append((&bucket.Id{Bounds: s.bounds}).BoundList(), math.Inf(1))
+			for i, le := range bounds {
+				bl := append(labels, metrics.PrometheusLabel{Name: "le", Value: metrics.PrometheusBound(le)})
+				writeScrapeLine(&buf, name+"_bucket", bl, s.buckets[i])
+			}
+			writeScrapeLine(&buf, name+"_sum", labels, s.val)
+			writeScrapeLine(&buf, name+"_count", labels, float64(s.count))
+		default:
+			writeScrapeLine(&buf, name, labels, s.val)
+		}
+	}
+	return buf.Bytes()
+}
+
+func scrapeType(t string) string {
+	switch t {
+	case "counter":
+		return "counter"
+	case "measurement":
+		return "summary"
+	case "histogram":
+		return "histogram"
+	default:
+		return "gauge"
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeScrapeLine(buf *bytes.Buffer, name string, labels []metrics.PrometheusLabel, val float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", l.Name, labelEscaper.Replace(l.Value))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(val, 'g', -1, 64))
+	buf.WriteByte('\n')
+}
+
+type byScrapeKey []*scrapeSeries
+
+func (s byScrapeKey) Len() int      { return len(s) }
+func (s byScrapeKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScrapeKey) Less(i, j int) bool {
+	a, b := s[i].key, s[j].key
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	if a.Source != b.Source {
+		return a.Source < b.Source
+	}
+	return a.Tags < b.Tags
+}
+
+// Keep an eye on the lenghts of our buffers.
+// If they are maxed out, something is going wrong.
+func (l *PrometheusScrapeOutlet) Report(ctx context.Context) {
+	defer l.running.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		l.Lock()
+		l.prune(time.Now())
+		l.Unlock()
+		pre := "prometheus-scrape."
+		l.Mchan.Measure(pre+"inbox", float64(len(l.inbox)))
+	}
+}
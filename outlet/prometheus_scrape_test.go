@@ -0,0 +1,118 @@
+package outlet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+func scrapeBucket(token, name, typ, source, tags string, vals ...float64) *bucket.Bucket {
+	id := &bucket.Id{
+		Name:       name,
+		Type:       typ,
+		Source:     source,
+		Tags:       tags,
+		Auth:       token,
+		Resolution: time.Minute,
+	}
+	b := &bucket.Bucket{Id: id}
+	for _, v := range vals {
+		b.Append(v)
+	}
+	return b
+}
+
+func TestPrometheusScrapeRender(t *testing.T) {
+	l := NewPrometheusScrapeOutlet(&conf.D{BufferSize: 1}, nil)
+	l.Mchan = new(metchan.Channel)
+	setTestKey(t)
+	tok := encrypt(t, "user")
+	l.add(scrapeBucket(tok, "db.latency", "measurement", "web.1", "", 1, 2, 3))
+	l.add(scrapeBucket(tok, "jobs", "counter", "", "region:us", 2))
+	l.add(scrapeBucket(tok, "jobs", "counter", "", "region:us", 3))
+	l.add(scrapeBucket(tok, "db.size", "sample", "", "", 10, 20))
+
+	expected := `# TYPE db_latency summary
+db_latency{source="web.1",quantile="0.5"} 2
+db_latency{source="web.1",quantile="0.95"} 3
+db_latency{source="web.1",quantile="0.99"} 3
+db_latency_sum{source="web.1"} 6
+db_latency_count{source="web.1"} 3
+# TYPE db_size gauge
+db_size 20
+# TYPE jobs counter
+jobs{region="us"} 5
+`
+	l.Lock()
+	actual := string(l.render("user", time.Now()))
+	l.Unlock()
+	if actual != expected {
+		t.Fatalf("actual=\n%s\nexpected=\n%s\n", actual, expected)
+	}
+}
+
+func TestPrometheusScrapeExpiry(t *testing.T) {
+	l := NewPrometheusScrapeOutlet(&conf.D{BufferSize: 1}, nil)
+	l.Mchan = new(metchan.Channel)
+	setTestKey(t)
+	tok := encrypt(t, "user")
+	l.add(scrapeBucket(tok, "jobs", "counter", "", "", 1))
+	l.Lock()
+	actual := l.render("user", time.Now().Add(time.Hour))
+	l.Unlock()
+	if len(actual) != 0 {
+		t.Fatalf("expected expired series to be dropped, actual=%s\n", actual)
+	}
+}
+
+func TestPrometheusScrapePrunesUnscrapedUsers(t *testing.T) {
+	setTestKey(t)
+	l := NewPrometheusScrapeOutlet(&conf.D{BufferSize: 1}, nil)
+	l.Mchan = new(metchan.Channel)
+	for _, user := range []string{"a", "b"} {
+		l.add(scrapeBucket(encrypt(t, user), "jobs", "counter", "", "", 1))
+	}
+	l.add(scrapeBucket("garbage", "jobs", "counter", "", "", 1))
+	l.Lock()
+	defer l.Unlock()
+	if len(l.series) != 2 {
+		t.Fatalf("actual-users=%d expected-users=2\n", len(l.series))
+	}
+	l.prune(time.Now())
+	if len(l.series) != 2 {
+		t.Errorf("fresh series should be kept, actual-users=%d\n", len(l.series))
+	}
+	l.prune(time.Now().Add(time.Hour))
+	if len(l.series) != 0 {
+		t.Errorf("actual-users=%d expected-users=0\n", len(l.series))
+	}
+}
+
+func TestPrometheusScrapeHistogram(t *testing.T) {
+	l := NewPrometheusScrapeOutlet(&conf.D{BufferSize: 1}, nil)
+	l.Mchan = new(metchan.Channel)
+	setTestKey(t)
+	tok := encrypt(t, "user")
+	b := scrapeBucket(tok, "latency", "histogram", "", "", 5, 50)
+	b.Id.Bounds = "10"
+	l.add(b)
+	b = scrapeBucket(tok, "latency", "histogram", "", "", 1)
+	b.Id.Bounds = "10"
+	l.add(b)
+
+	expected := `# TYPE latency histogram
+latency_bucket{le="10"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 56
+latency_count 3
+`
+	l.Lock()
+	actual := string(l.render("user", time.Now()))
+	l.Unlock()
+	if actual != expected {
+		t.Fatalf("actual=\n%s\nexpected=\n%s\n", actual, expected)
+	}
+}
@@ -0,0 +1,264 @@
+package outlet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+// A payload that could not be delivered. Auth is the
+// encrypted credential so that nothing secret is written
+// to disk; it is decrypted again for every attempt.
+type retryEntry struct {
+	Auth     string    `json:"auth"`
+	Body     []byte    `json:"body"`
+	First    time.Time `json:"first"`
+	Next     time.Time `json:"next"`
+	Attempts int       `json:"attempts"`
+	file     string
+}
+
+// Holds payloads that an outlet failed to post and retries
+// them with exponential backoff and jitter until they are
+// delivered or older than the max age. If a directory is
+// configured each entry is also kept in a file there, so the
+// queue survives restarts.
+type RetryQueue struct {
+	sync.Mutex
+	name       string
+	dir        string
+	entries    []*retryEntry
+	seq        int
+	send       func(auth string, body []byte) error
+	maxAge     time.Duration
+	maxEntries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	cancel     context.CancelFunc
+	done       chan struct{}
+	Mchan      *metchan.Channel
+}
+
+// Builds a queue for the named outlet that delivers with send.
+// Entries left in the outlet's directory by an earlier process
+// are loaded. Disk problems are logged and the queue falls back
+// to memory.
+func NewRetryQueue(name string, cfg *conf.D, send func(string, []byte) error) *RetryQueue {
+	q := &RetryQueue{
+		name:       name,
+		send:       send,
+		maxAge:     cfg.RetryMaxAge,
+		maxEntries: cfg.RetryMaxEntries,
+		backoff:    cfg.RetryBackoff,
+		maxBackoff: cfg.RetryMaxBackoff,
+	}
+	if len(cfg.RetryDir) > 0 {
+		q.dir = filepath.Join(cfg.RetryDir, name)
+		if err := q.load(); err != nil {
+			fmt.Printf("error=retry-queue outlet=%s msg=%s\n", name, err)
+			q.dir = ""
+		}
+	}
+	return q
+}
+
+func (q *RetryQueue) load() error {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(q.dir, f.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e := new(retryEntry)
+		if err := json.Unmarshal(b, e); err != nil {
+			fmt.Printf("error=retry-queue outlet=%s file=%s msg=%s\n", q.name, path, err)
+			os.Remove(path)
+			continue
+		}
+		e.file = path
+		q.entries = append(q.entries, e)
+	}
+	sort.Sort(byFirst(q.entries))
+	return nil
+}
+
+// Queues a payload for a later attempt. The oldest
+// entry is dropped if the queue is full.
+func (q *RetryQueue) Add(auth string, body []byte) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	e := &retryEntry{Auth: auth, Body: body, First: now}
+	e.Next = now.Add(q.delay(0))
+	if len(q.entries) >= q.maxEntries {
+		q.Mchan.Measure("outlet.drop", 1)
+		q.remove(0)
+	}
+	q.seq++
+	if len(q.dir) > 0 {
+		e.file = filepath.Join(q.dir, fmt.Sprintf("%d-%d.json", now.UnixNano(), q.seq))
+		q.write(e)
+	}
+	q.entries = append(q.entries, e)
+}
+
+// Exponential backoff with jitter: a random delay between
+// half and all of backoff * 2^attempts, capped at maxBackoff.
+func (q *RetryQueue) delay(attempts int) time.Duration {
+	d := q.maxBackoff
+	if attempts < 32 && q.backoff<<uint(attempts) < q.maxBackoff {
+		d = q.backoff << uint(attempts)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Must be called with the lock held.
+func (q *RetryQueue) write(e *retryEntry) {
+	b, err := json.Marshal(e)
+	if err == nil {
+		tmp := e.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, e.file)
+		}
+	}
+	if err != nil {
+		fmt.Printf("error=retry-queue outlet=%s file=%s msg=%s\n", q.name, e.file, err)
+	}
+}
+
+// Must be called with the lock held.
+func (q *RetryQueue) remove(i int) {
+	if len(q.entries[i].file) > 0 {
+		os.Remove(q.entries[i].file)
+	}
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+}
+
+// Retries due entries every tick until ctx is done or Stop is
+// called. Entries still queued at that point stay on disk.
+func (q *RetryQueue) Start(ctx context.Context, tick time.Duration) {
+	ctx, q.cancel = context.WithCancel(ctx)
+	q.done = make(chan struct{})
+	go func() {
+		defer close(q.done)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				q.retry(time.Now())
+				q.report()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (q *RetryQueue) Stop() {
+	q.cancel()
+	<-q.done
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries) > 0 && len(q.dir) == 0 {
+		fmt.Printf("at=retry-queue outlet=%s dropped=%d\n", q.name, len(q.entries))
+	}
+}
+
+// Attempts every entry that is due. The lock is not held
+// while posting so that Add doesn't wait on the network.
+func (q *RetryQueue) retry(now time.Time) {
+	q.Lock()
+	var due []*retryEntry
+	for i := 0; i < len(q.entries); i++ {
+		e := q.entries[i]
+		if now.Sub(e.First) > q.maxAge {
+			q.Mchan.Measure("outlet.drop", 1)
+			q.remove(i)
+			i--
+			continue
+		}
+		if !e.Next.After(now) {
+			due = append(due, e)
+		}
+	}
+	q.Unlock()
+
+	for _, e := range due {
+		err := q.send(e.Auth, e.Body)
+		q.Lock()
+		i := q.index(e)
+		if i < 0 {
+			// Dropped by Add while we were posting.
+			q.Unlock()
+			continue
+		}
+		if err == nil {
+			q.Mchan.Measure("outlet.retry.success", 1)
+			q.remove(i)
+		} else {
+			fmt.Printf("measure.%s.retry-error attempt=%d msg=%s\n", q.name, e.Attempts, err)
+			e.Attempts++
+			e.Next = time.Now().Add(q.delay(e.Attempts))
+			if len(e.file) > 0 {
+				q.write(e)
+			}
+		}
+		q.Unlock()
+	}
+}
+
+// Must be called with the lock held.
+func (q *RetryQueue) index(e *retryEntry) int {
+	for i := range q.entries {
+		if q.entries[i] == e {
+			return i
+		}
+	}
+	return -1
+}
+
+// The number of queued payloads and the age
+// of the oldest one.
+func (q *RetryQueue) Depth() (int, time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries) == 0 {
+		return 0, 0
+	}
+	return len(q.entries), time.Since(q.entries[0].First)
+}
+
+func (q *RetryQueue) report() {
+	n, age := q.Depth()
+	pre := q.name + "-outlet.retry."
+	q.Mchan.Measure(pre+"depth", float64(n))
+	q.Mchan.Measure(pre+"age", age.Seconds())
+}
+
+type byFirst []*retryEntry
+
+func (a byFirst) Len() int           { return len(a) }
+func (a byFirst) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byFirst) Less(i, j int) bool { return a[i].First.Before(a[j].First) }
@@ -0,0 +1,131 @@
+package outlet
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/conf"
+)
+
+// Fails the first n posts, then records the bodies.
+type flakySender struct {
+	sync.Mutex
+	n      int
+	calls  int
+	bodies []string
+}
+
+func (f *flakySender) send(auth string, body []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls++
+	if f.calls <= f.n {
+		return errors.New("unavailable")
+	}
+	f.bodies = append(f.bodies, string(body))
+	return nil
+}
+
+func retryConf(dir string) *conf.D {
+	return &conf.D{
+		RetryDir:        dir,
+		RetryMaxAge:     time.Hour,
+		RetryBackoff:    time.Millisecond,
+		RetryMaxBackoff: time.Millisecond * 4,
+		RetryMaxEntries: 2,
+	}
+}
+
+func TestRetryQueueDelivers(t *testing.T) {
+	f := &flakySender{n: 2}
+	q := NewRetryQueue("test", retryConf(""), f.send)
+	q.Add("token", []byte("a"))
+	q.Start(context.Background(), time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for n, _ := q.Depth(); n > 0; n, _ = q.Depth() {
+		if time.Now().After(deadline) {
+			t.Fatalf("payload was not delivered\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.Stop()
+	if f.calls != 3 || len(f.bodies) != 1 || f.bodies[0] != "a" {
+		t.Errorf("actual-calls=%d actual-bodies=%v expected=3,[a]\n", f.calls, f.bodies)
+	}
+}
+
+func TestRetryQueueMaxAge(t *testing.T) {
+	f := new(flakySender)
+	q := NewRetryQueue("test", retryConf(""), f.send)
+	q.Add("token", []byte("a"))
+	q.retry(time.Now().Add(2 * time.Hour))
+	if n, _ := q.Depth(); n != 0 || f.calls != 0 {
+		t.Errorf("actual-depth=%d actual-calls=%d expected=0,0\n", n, f.calls)
+	}
+}
+
+func TestRetryQueueMaxEntries(t *testing.T) {
+	f := new(flakySender)
+	q := NewRetryQueue("test", retryConf(""), f.send)
+	for _, b := range []string{"a", "b", "c"} {
+		q.Add("token", []byte(b))
+	}
+	q.retry(time.Now().Add(time.Second))
+	if len(f.bodies) != 2 || f.bodies[0] != "b" || f.bodies[1] != "c" {
+		t.Errorf("actual=%v expected=[b c]\n", f.bodies)
+	}
+}
+
+func TestRetryQueuePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l2met-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := new(flakySender)
+	NewRetryQueue("test", retryConf(dir), f.send).Add("token", []byte("a"))
+
+	// A new process picks up where the last one left off.
+	q := NewRetryQueue("test", retryConf(dir), f.send)
+	if n, _ := q.Depth(); n != 1 {
+		t.Fatalf("actual-depth=%d expected-depth=1\n", n)
+	}
+	q.retry(time.Now().Add(time.Second))
+	if len(f.bodies) != 1 || f.bodies[0] != "a" {
+		t.Errorf("actual=%v expected=[a]\n", f.bodies)
+	}
+	if n, _ := NewRetryQueue("test", retryConf(dir), f.send).Depth(); n != 0 {
+		t.Errorf("delivered payload was left on disk\n")
+	}
+}
+
+func TestRetryQueueDelay(t *testing.T) {
+	q := NewRetryQueue("test", &conf.D{
+		RetryBackoff:    time.Second,
+		RetryMaxBackoff: time.Minute,
+	}, nil)
+	cases := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, time.Minute},
+		{100, time.Minute},
+	}
+	for _, c := range cases {
+		for i := 0; i < 10; i++ {
+			d := q.delay(c.attempts)
+			if d < c.max/2 || d > c.max {
+				t.Errorf("attempts=%d actual=%s expected between %s and %s\n",
+					c.attempts, d, c.max/2, c.max)
+			}
+		}
+	}
+}
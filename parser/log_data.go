@@ -2,9 +2,17 @@ package parser
 
 import (
 	"bytes"
+	"sort"
+	"strings"
+
 	"github.com/kr/logfmt"
 )
 
+var (
+	tagPrefix = "tag#"
+	tagsKey   = "tags"
+)
+
 type tuples []*tuple
 
 func (t *tuples) HandleLogfmt(k, v []byte) error {
@@ -45,3 +53,49 @@ func (ld *logData) Source() string {
 	}
 	return ""
 }
+
+// Collects the tags found in the log line. Tags can be given
+// individually with tag#key=val or as a list with tags=a:b,c:d.
+// The result is sorted and de-duplicated so that the same set of
+// tags always produces the same bucket.Id.
+func (ld *logData) Tags() string {
+	var tags []string
+	for _, tuple := range ld.Tuples {
+		name := tuple.Name()
+		switch {
+		case strings.HasPrefix(name, tagPrefix):
+			k := name[len(tagPrefix):]
+			if len(k) == 0 {
+				continue
+			}
+			if len(tuple.Val) == 0 {
+				tags = append(tags, k)
+			} else {
+				tags = append(tags, k+":"+tuple.String())
+			}
+		case name == tagsKey:
+			for _, t := range strings.Split(tuple.String(), ",") {
+				if len(t) > 0 {
+					tags = append(tags, t)
+				}
+			}
+		}
+	}
+	return joinTags(tags)
+}
+
+// Sorts and de-duplicates tags and joins them into the
+// form stored in bucket.Id.Tags.
+func joinTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	sort.Strings(tags)
+	uniq := tags[:1]
+	for _, t := range tags[1:] {
+		if t != uniq[len(uniq)-1] {
+			uniq = append(uniq, t)
+		}
+	}
+	return strings.Join(uniq, ",")
+}
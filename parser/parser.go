@@ -4,6 +4,7 @@ package parser
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -21,20 +22,35 @@ var bucketDropExpr = regexp.MustCompile(`\:\s(\d+)\smessages`)
 type options map[string][]string
 
 var (
-	logplexPrefix = "logplex"
-	routerPrefix  = "router"
-	legacyPrefix  = "measure."
-	measurePrefix = "measure#"
-	samplePrefix  = "sample#"
-	counterPrefix = "count#"
+	logplexPrefix   = "logplex"
+	routerPrefix    = "router"
+	legacyPrefix    = "measure."
+	measurePrefix   = "measure#"
+	samplePrefix    = "sample#"
+	counterPrefix   = "count#"
+	histogramPrefix = "histogram#"
+	uniquePrefix    = "unique#"
 )
 
+// Histogram boundaries used when the request doesn't
+// provide a histogram-buckets option.
+var DefaultHistogramBuckets = "10,25,50,100,250,500,1000,2500,5000,10000"
+
+// Percentiles used when the request doesn't
+// provide a percentiles option.
+var DefaultPercentiles = bucket.DefaultPercentiles
+
 type parser struct {
 	out   chan *bucket.Bucket
 	lr    *lpx.Reader
+	hdr   *lpx.Header
+	msg   []byte
 	ld    *logData
 	opts  options
 	mchan *metchan.Channel
+	// The user the rules are evaluated for,
+	// once the credential has been decrypted.
+	user *string
 }
 
 func BuildBuckets(body *bufio.Reader, opts options, m *metchan.Channel) <-chan *bucket.Bucket {
@@ -51,21 +67,30 @@ func BuildBuckets(body *bufio.Reader, opts options, m *metchan.Channel) <-chan *
 func (p *parser) parse() {
 	defer close(p.out)
 	for p.lr.Next() {
-		if p.handleHkLogplexErr() {
-			continue
-		}
-		p.ld.Reset()
-		if err := p.ld.Read(p.lr.Bytes()); err != nil {
-			fmt.Printf("error=%s\n", err)
-			continue
-		}
-		for _, t := range p.ld.Tuples {
-			p.handleCounters(t)
-			p.handleSamples(t)
-			p.handleHkRouter(t)
-			p.handlMeasurements(t)
-			p.handleLegacyMeasurements(t)
-		}
+		p.hdr = p.lr.Header()
+		p.msg = p.lr.Bytes()
+		p.handle()
+	}
+}
+
+// Runs the current message through the tuple handlers.
+func (p *parser) handle() {
+	if p.handleHkLogplexErr() {
+		return
+	}
+	p.ld.Reset()
+	if err := p.ld.Read(p.msg); err != nil {
+		fmt.Printf("error=%s\n", err)
+		return
+	}
+	for _, t := range p.ld.Tuples {
+		p.handleCounters(t)
+		p.handleSamples(t)
+		p.handleHistograms(t)
+		p.handleUniques(t)
+		p.handleHkRouter(t)
+		p.handlMeasurements(t)
+		p.handleLegacyMeasurements(t)
 	}
 }
 
@@ -80,7 +105,40 @@ func (p *parser) handleSamples(t *tuple) error {
 	if err != nil {
 		return err
 	}
-	p.out <- &bucket.Bucket{Id: id, Vals: []float64{val}}
+	p.emit(&bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val})
+	return nil
+}
+
+func (p *parser) handleHistograms(t *tuple) error {
+	if !strings.HasPrefix(t.Name(), histogramPrefix) {
+		return nil
+	}
+	id := new(bucket.Id)
+	p.buildId(id, t)
+	id.Type = "histogram"
+	id.Bounds = p.HistogramBuckets()
+	val, err := t.Float64()
+	if err != nil {
+		return err
+	}
+	p.emit(&bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val})
+	return nil
+}
+
+func (p *parser) handleUniques(t *tuple) error {
+	if !strings.HasPrefix(t.Name(), uniquePrefix) {
+		return nil
+	}
+	if len(t.Val) == 0 {
+		return errors.New("Unique requires a value.")
+	}
+	id := new(bucket.Id)
+	p.buildId(id, t)
+	id.Type = "unique"
+	id.Units = ""
+	b := &bucket.Bucket{Id: id}
+	b.AddUnique(t.String())
+	p.emit(b)
 	return nil
 }
 
@@ -95,7 +153,7 @@ func (p *parser) handleCounters(t *tuple) error {
 	if err != nil {
 		return err
 	}
-	p.out <- &bucket.Bucket{Id: id, Vals: []float64{val}}
+	p.emit(&bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val})
 	return nil
 }
 
@@ -106,11 +164,12 @@ func (p *parser) handleLegacyMeasurements(t *tuple) error {
 	id := new(bucket.Id)
 	p.buildId(id, t)
 	id.Type = "measurement"
+	id.Percentiles = p.Percentiles()
 	val, err := t.Float64()
 	if err != nil {
 		return err
 	}
-	p.out <- &bucket.Bucket{Id: id, Vals: []float64{val}}
+	p.emit(&bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val})
 	return nil
 }
 
@@ -121,19 +180,20 @@ func (p *parser) handlMeasurements(t *tuple) error {
 	id := new(bucket.Id)
 	p.buildId(id, t)
 	id.Type = "measurement"
+	id.Percentiles = p.Percentiles()
 	val, err := t.Float64()
 	if err != nil {
 		return err
 	}
-	p.out <- &bucket.Bucket{Id: id, Vals: []float64{val}}
+	p.emit(&bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val})
 	return nil
 }
 
 func (p *parser) handleHkLogplexErr() bool {
-	if string(p.lr.Header().Procid) != logplexPrefix {
+	if string(p.hdr.Procid) != logplexPrefix {
 		return false
 	}
-	matches := bucketDropExpr.FindStringSubmatch(string(p.lr.Bytes()))
+	matches := bucketDropExpr.FindStringSubmatch(string(p.msg))
 	if len(matches) < 2 {
 		return false
 	}
@@ -141,21 +201,21 @@ func (p *parser) handleHkLogplexErr() bool {
 	if err != nil {
 		return false
 	}
-	if decr, err := auth.Decrypt(p.Auth()); err == nil {
-		user := strings.Split(decr, ":")[0]
-		fmt.Printf("error=logplex.l10 drops=%d user=%s\n", numDrops, user)
+	if creds, err := auth.DecryptCredential(p.Auth()); err == nil {
+		fmt.Printf("error=logplex.l10 drops=%d user=%s\n", numDrops, creds.User())
 	}
 	p.mchan.Measure("logplex.l10", float64(numDrops))
 	return true
 }
 
 func (p *parser) handleHkRouter(t *tuple) error {
-	if string(p.lr.Header().Procid) != routerPrefix {
+	if string(p.hdr.Procid) != routerPrefix {
 		return nil
 	}
 	id := new(bucket.Id)
 	p.buildId(id, t)
 	id.Type = "measurement"
+	id.Percentiles = p.Percentiles()
 	switch t.Name() {
 	case "bytes":
 		id.Name = p.Prefix("router.bytes")
@@ -170,7 +230,7 @@ func (p *parser) handleHkRouter(t *tuple) error {
 	if err != nil {
 		return err
 	}
-	p.out <- &bucket.Bucket{Id: id, Vals: []float64{val}}
+	p.emit(&bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val})
 	return nil
 }
 
@@ -182,6 +242,7 @@ func (p *parser) buildId(id *bucket.Id, t *tuple) {
 	id.Name = p.Prefix(t.Name())
 	id.Units = t.Units()
 	id.Source = p.SourcePrefix(p.ld.Source())
+	id.Tags = p.ld.Tags()
 	return
 }
 
@@ -210,6 +271,12 @@ func (p *parser) Prefix(suffix string) string {
 	if strings.HasPrefix(suffix, samplePrefix) {
 		suffix = suffix[len(samplePrefix):]
 	}
+	if strings.HasPrefix(suffix, histogramPrefix) {
+		suffix = suffix[len(histogramPrefix):]
+	}
+	if strings.HasPrefix(suffix, uniquePrefix) {
+		suffix = suffix[len(uniquePrefix):]
+	}
 	pre, present := p.opts["prefix"]
 	if !present {
 		return suffix
@@ -217,17 +284,51 @@ func (p *parser) Prefix(suffix string) string {
 	return pre[0] + "." + suffix
 }
 
+// Histogram boundaries from the histogram-buckets option,
+// falling back to DefaultHistogramBuckets if it is missing
+// or malformed.
+func (p *parser) HistogramBuckets() string {
+	s, present := p.opts["histogram-buckets"]
+	if !present {
+		s = []string{DefaultHistogramBuckets}
+	}
+	bounds, err := bucket.ParseBounds(s[0])
+	if err != nil || len(bounds) == 0 {
+		bounds, _ = bucket.ParseBounds(DefaultHistogramBuckets)
+	}
+	return bucket.FormatBounds(bounds)
+}
+
+// Percentiles from the percentiles option, falling back
+// to DefaultPercentiles if it is missing or malformed.
+func (p *parser) Percentiles() string {
+	s, present := p.opts["percentiles"]
+	if !present {
+		s = []string{DefaultPercentiles}
+	}
+	pcts, err := bucket.ParsePercentiles(s[0])
+	if err != nil || len(pcts) == 0 {
+		pcts, _ = bucket.ParsePercentiles(DefaultPercentiles)
+	}
+	return bucket.FormatBounds(pcts)
+}
+
 func (p *parser) Auth() string {
 	return p.opts["auth"][0]
 }
 
 func (p *parser) Time() time.Time {
-	ts := string(p.lr.Header().Time)
-	d := p.Resolution()
+	ts := string(p.hdr.Time)
 	t, err := time.Parse(time.RFC3339, ts)
 	if err != nil {
 		t = time.Now()
 	}
+	return p.truncate(t)
+}
+
+// Truncates t to the resolution of the request.
+func (p *parser) truncate(t time.Time) time.Time {
+	d := p.Resolution()
 	return time.Unix(0, int64((time.Duration(t.UnixNano())/d)*d))
 }
 
@@ -3,6 +3,7 @@ package parser
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/DataDog/l2met/bucket"
@@ -87,3 +88,117 @@ func testNames(t *testing.T, b []*bucket.Bucket, tc testCase) {
 		}
 	}
 }
+
+var tagTest = []struct {
+	tname string
+	in    string
+	tags  string
+}{
+	{
+		"tag convention",
+		`94 <174>1 2013-07-22T00:06:26-00:00 somehost name test - tag#region=us tag#dyno=web.1 measure#a=1`,
+		"dyno:web.1,region:us",
+	},
+	{
+		"tags list",
+		`91 <174>1 2013-07-22T00:06:26-00:00 somehost name test - tags=region:us,dyno:web.1 measure#a=1`,
+		"dyno:web.1,region:us",
+	},
+	{
+		"no tags",
+		`65 <174>1 2013-07-22T00:06:26-00:00 somehost name test - measure#a=1`,
+		"",
+	},
+}
+
+func TestBuildBucketsHistogram(t *testing.T) {
+	in := `75 <174>1 2013-07-22T00:06:26-00:00 somehost name test - histogram#latency=4ms`
+	for _, tc := range []struct {
+		opts   options
+		bounds string
+	}{
+		{options{"auth": []string{"abc123"}}, DefaultHistogramBuckets},
+		{options{"auth": []string{"abc123"}, "histogram-buckets": []string{"5,1"}}, "1,5"},
+		{options{"auth": []string{"abc123"}, "histogram-buckets": []string{"x"}}, DefaultHistogramBuckets},
+	} {
+		body := bufio.NewReader(bytes.NewBufferString(in))
+		buckets := make([]*bucket.Bucket, 0)
+		for b := range BuildBuckets(body, tc.opts, new(metchan.Channel)) {
+			buckets = append(buckets, b)
+		}
+		if len(buckets) != 1 {
+			t.Fatalf("actual-len=%d expected-len=1\n", len(buckets))
+		}
+		id := buckets[0].Id
+		if id.Name != "latency" || id.Type != "histogram" || id.Bounds != tc.bounds {
+			t.Errorf("actual=%s/%s/%s expected=latency/histogram/%s\n",
+				id.Name, id.Type, id.Bounds, tc.bounds)
+		}
+	}
+}
+
+// The store keeps the first bucket of an interval as it
+// was parsed, so its sum must already hold the value.
+// Otherwise a counter incremented once reports zero.
+func TestBuildBucketsSum(t *testing.T) {
+	line := "<174>1 2013-07-22T00:06:26-00:00 somehost name test - " +
+		"count#hits=3 sample#load=0.5 measure#a=2 measure.b=4 histogram#c=6"
+	in := fmt.Sprintf("%d %s", len(line), line)
+	body := bufio.NewReader(bytes.NewBufferString(in))
+	opts := options{"auth": []string{"abc123"}}
+	sums := map[string]float64{"hits": 3, "load": 0.5, "a": 2, "b": 4, "c": 6}
+	n := 0
+	for b := range BuildBuckets(body, opts, new(metchan.Channel)) {
+		n++
+		if b.Sum != sums[b.Id.Name] {
+			t.Errorf("name=%s actual-sum=%f expected-sum=%f\n",
+				b.Id.Name, b.Sum, sums[b.Id.Name])
+		}
+	}
+	if n != len(sums) {
+		t.Fatalf("actual-len=%d expected-len=%d\n", n, len(sums))
+	}
+}
+
+func TestBuildBucketsPercentiles(t *testing.T) {
+	in := `65 <174>1 2013-07-22T00:06:26-00:00 somehost name test - measure#a=1`
+	for _, tc := range []struct {
+		opts        options
+		percentiles string
+	}{
+		{options{"auth": []string{"abc123"}}, DefaultPercentiles},
+		{options{"auth": []string{"abc123"}, "percentiles": []string{"99.9,50,90"}}, "50,90,99.9"},
+		{options{"auth": []string{"abc123"}, "percentiles": []string{"200"}}, DefaultPercentiles},
+	} {
+		body := bufio.NewReader(bytes.NewBufferString(in))
+		buckets := make([]*bucket.Bucket, 0)
+		for b := range BuildBuckets(body, tc.opts, new(metchan.Channel)) {
+			buckets = append(buckets, b)
+		}
+		if len(buckets) != 1 {
+			t.Fatalf("actual-len=%d expected-len=1\n", len(buckets))
+		}
+		if buckets[0].Id.Percentiles != tc.percentiles {
+			t.Errorf("actual=%s expected=%s\n", buckets[0].Id.Percentiles, tc.percentiles)
+		}
+	}
+}
+
+func TestBuildBucketsTags(t *testing.T) {
+	for _, tc := range tagTest {
+		body := bufio.NewReader(bytes.NewBufferString(tc.in))
+		opts := options{"auth": []string{"abc123"}}
+		buckets := make([]*bucket.Bucket, 0)
+		for b := range BuildBuckets(body, opts, new(metchan.Channel)) {
+			buckets = append(buckets, b)
+		}
+		if len(buckets) != 1 {
+			t.Fatalf("test=%s actual-len=%d expected-len=1\n",
+				tc.tname, len(buckets))
+		}
+		if buckets[0].Id.Tags != tc.tags {
+			t.Fatalf("test=%s actual-tags=%s expected-tags=%s\n",
+				tc.tname, buckets[0].Id.Tags, tc.tags)
+		}
+	}
+}
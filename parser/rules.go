@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"regexp"
+	"sync/atomic"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+)
+
+type rule struct {
+	name, source  *regexp.Regexp
+	action        string
+	rename        string
+	rewriteSource string
+}
+
+// Compiled conf.Rules: the global rules plus the rules for
+// each user, which run before the global ones.
+type RuleSet struct {
+	global []rule
+	byUser map[string][]rule
+}
+
+// Holds the *RuleSet in use. Swapped as
+// a whole so rules can be reloaded.
+var rules atomic.Value
+
+// Compiles the rules. The rules should have been
+// checked by conf.D.Validate.
+func NewRuleSet(global []conf.Rule, byUser map[string][]conf.Rule) (*RuleSet, error) {
+	rs := &RuleSet{byUser: make(map[string][]rule)}
+	var err error
+	if rs.global, err = compileRules(global); err != nil {
+		return nil, err
+	}
+	for user, r := range byUser {
+		if rs.byUser[user], err = compileRules(r); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+func compileRules(rules []conf.Rule) ([]rule, error) {
+	compiled := make([]rule, len(rules))
+	for i, r := range rules {
+		c := &compiled[i]
+		var err error
+		if len(r.Name) > 0 {
+			if c.name, err = regexp.Compile(r.Name); err != nil {
+				return nil, err
+			}
+		}
+		if len(r.Source) > 0 {
+			if c.source, err = regexp.Compile(r.Source); err != nil {
+				return nil, err
+			}
+		}
+		c.action = r.Action
+		c.rename = r.Rename
+		c.rewriteSource = r.RewriteSource
+	}
+	return compiled, nil
+}
+
+// Replaces the rules used by the parser.
+func SetRules(rs *RuleSet) {
+	rules.Store(rs)
+}
+
+func currentRules() *RuleSet {
+	rs, _ := rules.Load().(*RuleSet)
+	return rs
+}
+
+// Runs the user's rules and then the global rules over id.
+// Returns false if the bucket should be dropped.
+func (rs *RuleSet) Apply(user string, id *bucket.Id) bool {
+	for _, set := range [][]rule{rs.byUser[user], rs.global} {
+		for i := range set {
+			r := &set[i]
+			if r.name != nil && !r.name.MatchString(id.Name) {
+				continue
+			}
+			if r.source != nil && !r.source.MatchString(id.Source) {
+				continue
+			}
+			switch r.action {
+			case "keep":
+				return true
+			case "drop":
+				return false
+			}
+			if len(r.rename) > 0 {
+				id.Name = replace(r.name, id.Name, r.rename)
+			}
+			if len(r.rewriteSource) > 0 {
+				id.Source = replace(r.source, id.Source, r.rewriteSource)
+			}
+		}
+	}
+	return true
+}
+
+// Expands the capture groups of expr in repl.
+// Without an expression repl is used as is.
+func replace(expr *regexp.Regexp, s, repl string) string {
+	if expr == nil {
+		return repl
+	}
+	return expr.ReplaceAllString(s, repl)
+}
+
+// Applies the rules in use to id. Per-user rules need the
+// decrypted credential, which is looked up once per parser.
+func (p *parser) applyRules(id *bucket.Id) bool {
+	rs := currentRules()
+	if rs == nil {
+		return true
+	}
+	if len(rs.byUser) > 0 && p.user == nil {
+		var user string
+		if creds, err := auth.DecryptCredential(id.Auth); err == nil {
+			user = creds.User()
+		}
+		p.user = &user
+	}
+	var user string
+	if p.user != nil {
+		user = *p.user
+	}
+	if !rs.Apply(user, id) {
+		p.mchan.Measure("parser.rule-drop", 1)
+		return false
+	}
+	return true
+}
+
+// Sends the bucket on unless a rule drops it.
+func (p *parser) emit(b *bucket.Bucket) {
+	if p.applyRules(b.Id) {
+		p.out <- b
+	}
+}
@@ -0,0 +1,80 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+func TestRuleSetApply(t *testing.T) {
+	rs, err := NewRuleSet([]conf.Rule{
+		{Name: `^debug\.`, Action: "drop"},
+		{Name: `^web\.request\.[0-9a-f]+\.(\w+)$`, Rename: "web.request.$1"},
+		{Source: `^(web|worker)\.\d+$`, RewriteSource: "$1"},
+		{Source: `^canary$`, Action: "drop"},
+	}, map[string][]conf.Rule{
+		"vip": {
+			{Name: `^debug\.keep$`, Action: "keep"},
+			{Name: `^old$`, Rename: "new"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user, name, source string
+		expectedName       string
+		expectedSource     string
+		expectedOk         bool
+	}{
+		{"a", "db.latency", "web.1", "db.latency", "web", true},
+		{"a", "debug.keep", "web.1", "", "", false},
+		{"a", "web.request.a1b2c3.time", "worker.12", "web.request.time", "worker", true},
+		{"a", "web.request.time", "canary", "", "", false},
+		{"a", "old", "", "old", "", true},
+		{"vip", "debug.keep", "web.1", "debug.keep", "web.1", true},
+		{"vip", "old", "web.2", "new", "web", true},
+	}
+	for i, c := range cases {
+		id := &bucket.Id{Name: c.name, Source: c.source}
+		ok := rs.Apply(c.user, id)
+		if ok != c.expectedOk {
+			t.Errorf("case=%d actual-ok=%t expected-ok=%t\n", i, ok, c.expectedOk)
+			continue
+		}
+		if ok && (id.Name != c.expectedName || id.Source != c.expectedSource) {
+			t.Errorf("case=%d actual=%s,%s expected=%s,%s\n",
+				i, id.Name, id.Source, c.expectedName, c.expectedSource)
+		}
+	}
+}
+
+func TestBuildBucketsRules(t *testing.T) {
+	rs, err := NewRuleSet([]conf.Rule{
+		{Name: `^(app)\.debug\.`, Action: "drop"},
+		{Name: `^app\.(\w+)\.\d+$`, Rename: "app.$1"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRules(rs)
+	defer SetRules(nil)
+
+	// Rules see the name after the prefix option is applied.
+	line := "<174>1 2013-07-22T00:06:26-00:00 somehost name test - " +
+		"measure#debug.x=1 measure#jobs.123=2 measure#other=3"
+	body := bufio.NewReader(bytes.NewBufferString(fmt.Sprintf("%d %s", len(line), line)))
+	opts := options{"auth": []string{"abc123"}, "prefix": []string{"app"}}
+	var names []string
+	for b := range BuildBuckets(body, opts, new(metchan.Channel)) {
+		names = append(names, b.Id.Name)
+	}
+	if fmt.Sprint(names) != "[app.jobs app.other]" {
+		t.Errorf("actual=%v expected=[app.jobs app.other]\n", names)
+	}
+}
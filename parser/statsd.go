@@ -0,0 +1,125 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/metchan"
+)
+
+// StatsD types mapped to l2met bucket types.
+var statsdTypes = map[string]string{
+	"c":  "counter",
+	"ms": "measurement",
+	"h":  "measurement",
+	"g":  "sample",
+	"s":  "unique",
+}
+
+// Builds buckets from a StatsD or DogStatsD datagram. A datagram
+// contains newline separated metrics of the form:
+//
+//	name:value|type[|@rate][|#tag:val,tag]
+//
+// Unlike log lines, a datagram does not carry a timestamp so the
+// buckets are placed in the interval containing the current time.
+// Lines that cannot be parsed are counted and skipped.
+func BuildStatsdBuckets(msg []byte, opts options, m *metchan.Channel) []*bucket.Bucket {
+	p := new(parser)
+	p.mchan = m
+	p.opts = opts
+	now := time.Now()
+	var buckets []*bucket.Bucket
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		b, err := p.statsdBucket(string(line), now)
+		if err != nil {
+			p.mchan.Measure("receiver.statsd.error", 1)
+			continue
+		}
+		if b != nil && p.applyRules(b.Id) {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+func (p *parser) statsdBucket(line string, now time.Time) (*bucket.Bucket, error) {
+	colon := strings.Index(line, ":")
+	if colon < 1 {
+		return nil, errors.New("statsd: missing name")
+	}
+	name := line[:colon]
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return nil, errors.New("statsd: missing type")
+	}
+	typ, ok := statsdTypes[fields[1]]
+	if !ok {
+		// Types we do not support.
+		return nil, nil
+	}
+	var val float64
+	var err error
+	if typ != "unique" {
+		if val, err = strconv.ParseFloat(fields[0], 64); err != nil {
+			return nil, err
+		}
+	}
+	// A signed gauge adjusts the current value rather than setting it.
+	// Receivers keep no gauge state between intervals or with each other,
+	// so the adjustment cannot be applied and storing it would be wrong.
+	if typ == "sample" && (fields[0][0] == '+' || fields[0][0] == '-') {
+		return nil, errors.New("statsd: relative gauges are not supported")
+	}
+	var tags []string
+	rate := float64(1)
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err = strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, errors.New("statsd: bad sample rate")
+			}
+		case strings.HasPrefix(f, "#"):
+			for _, t := range strings.Split(f[1:], ",") {
+				if len(t) > 0 {
+					tags = append(tags, t)
+				}
+			}
+		}
+	}
+	// Counters are scaled up by the sample rate so that
+	// the sum reflects the number of events that occurred.
+	if typ == "counter" {
+		val = val / rate
+	}
+
+	id := new(bucket.Id)
+	id.Resolution = p.Resolution()
+	id.Time = p.truncate(now)
+	id.Auth = p.Auth()
+	id.ReadyAt = id.Time.Add(id.Resolution).Truncate(id.Resolution)
+	id.Name = p.Prefix(name)
+	id.Source = p.SourcePrefix("")
+	id.Tags = joinTags(tags)
+	id.Type = typ
+	if typ == "measurement" {
+		id.Percentiles = p.Percentiles()
+	}
+	if fields[1] == "ms" {
+		id.Units = "ms"
+	}
+	if typ == "unique" {
+		b := &bucket.Bucket{Id: id}
+		b.AddUnique(fields[0])
+		return b, nil
+	}
+	return &bucket.Bucket{Id: id, Vals: []float64{val}, Sum: val}, nil
+}
@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/DataDog/l2met/metchan"
+)
+
+var statsdTest = []struct {
+	tname string
+	in    string
+	opts  options
+	names []string
+	types []string
+	vals  []float64
+	tags  []string
+}{
+	{
+		"counter",
+		"hello:1|c",
+		options{"auth": []string{"abc123"}},
+		[]string{"hello"},
+		[]string{"counter"},
+		[]float64{1},
+		[]string{""},
+	},
+	{
+		"sampled counter",
+		"hello:1|c|@0.5",
+		options{"auth": []string{"abc123"}},
+		[]string{"hello"},
+		[]string{"counter"},
+		[]float64{2},
+		[]string{""},
+	},
+	{
+		"dogstatsd tags",
+		"db.latency:4|ms|#region:us,dyno:web.1",
+		options{"auth": []string{"abc123"}, "prefix": []string{"app"}},
+		[]string{"app.db.latency"},
+		[]string{"measurement"},
+		[]float64{4},
+		[]string{"dyno:web.1,region:us"},
+	},
+	{
+		"relative gauges",
+		"a:+1|g\nb:-2|g\nc:3|g",
+		options{"auth": []string{"abc123"}},
+		[]string{"c"},
+		[]string{"sample"},
+		[]float64{3},
+		[]string{""},
+	},
+	{
+		"multiple metrics",
+		"a:1|g\nb:2|h\nc:3|x\nbroken",
+		options{"auth": []string{"abc123"}},
+		[]string{"a", "b"},
+		[]string{"sample", "measurement"},
+		[]float64{1, 2},
+		[]string{"", ""},
+	},
+}
+
+func TestBuildStatsdSet(t *testing.T) {
+	in := "users:alice|s\nusers:bob|s\nusers:alice|s"
+	buckets := BuildStatsdBuckets([]byte(in), options{"auth": []string{"abc123"}}, new(metchan.Channel))
+	if len(buckets) != 3 {
+		t.Fatalf("actual-len=%d expected-len=3\n", len(buckets))
+	}
+	for _, b := range buckets[1:] {
+		buckets[0].Merge(b)
+	}
+	if buckets[0].Id.Type != "unique" || buckets[0].Unique() != 2 {
+		t.Fatalf("actual-type=%s actual-unique=%d expected=unique/2\n",
+			buckets[0].Id.Type, buckets[0].Unique())
+	}
+}
+
+func TestBuildStatsdBuckets(t *testing.T) {
+	for _, tc := range statsdTest {
+		buckets := BuildStatsdBuckets([]byte(tc.in), tc.opts, new(metchan.Channel))
+		if len(buckets) != len(tc.names) {
+			t.Fatalf("test=%s actual-len=%d expected-len=%d\n",
+				tc.tname, len(buckets), len(tc.names))
+		}
+		for i, b := range buckets {
+			if b.Id.Name != tc.names[i] {
+				t.Errorf("test=%s actual-name=%s expected-name=%s\n",
+					tc.tname, b.Id.Name, tc.names[i])
+			}
+			if b.Id.Type != tc.types[i] {
+				t.Errorf("test=%s actual-type=%s expected-type=%s\n",
+					tc.tname, b.Id.Type, tc.types[i])
+			}
+			if b.Vals[0] != tc.vals[i] {
+				t.Errorf("test=%s actual-val=%f expected-val=%f\n",
+					tc.tname, b.Vals[0], tc.vals[i])
+			}
+			if b.Sum != tc.vals[i] {
+				t.Errorf("test=%s actual-sum=%f expected-sum=%f\n",
+					tc.tname, b.Sum, tc.vals[i])
+			}
+			if b.Id.Tags != tc.tags[i] {
+				t.Errorf("test=%s actual-tags=%s expected-tags=%s\n",
+					tc.tname, b.Id.Tags, tc.tags[i])
+			}
+		}
+	}
+}
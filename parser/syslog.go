@@ -0,0 +1,198 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/bmizerany/lpx"
+)
+
+// Structured data elements with this id (or this id followed
+// by @enterprise-number) carry l2met options such as auth.
+const syslogSDID = "l2met"
+
+// A single syslog message with the header broken out
+// the same way lpx does for logplex messages.
+type SyslogMessage struct {
+	Header *lpx.Header
+	// Params from the l2met structured data element.
+	// These use the same names as the drain URL query options.
+	Params map[string][]string
+	Msg    []byte
+}
+
+// Parses an RFC5424 or RFC3164 message. The format is detected
+// by the version number that follows the PRI in RFC5424.
+func ParseSyslog(b []byte) (*SyslogMessage, error) {
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 || b[0] != '<' {
+		return nil, errors.New("syslog: missing pri")
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("syslog: malformed pri")
+	}
+	pri, rest := b[:end+1], b[end+1:]
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		return parse5424(pri, rest)
+	}
+	return parse3164(pri, rest, time.Now().UTC())
+}
+
+func parse5424(pri, rest []byte) (*SyslogMessage, error) {
+	var fields [6][]byte
+	for i := range fields {
+		fields[i], rest = nextField(rest)
+		if len(fields[i]) == 0 {
+			return nil, errors.New("syslog: short header")
+		}
+	}
+	m := &SyslogMessage{
+		Header: &lpx.Header{
+			PrivalVersion: append(append([]byte{}, pri...), fields[0]...),
+			Time:          fields[1],
+			Hostname:      fields[2],
+			Name:          fields[3],
+			Procid:        fields[4],
+			Msgid:         fields[5],
+		},
+		Params: make(map[string][]string),
+	}
+	switch {
+	case len(rest) > 0 && rest[0] == '-':
+		rest = rest[1:]
+	case len(rest) > 0 && rest[0] == '[':
+		var err error
+		if rest, err = parseSD(rest, m.Params); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("syslog: missing structured data")
+	}
+	if len(rest) > 0 && rest[0] == ' ' {
+		rest = rest[1:]
+	}
+	m.Msg = bytes.TrimPrefix(rest, []byte("\xef\xbb\xbf"))
+	return m, nil
+}
+
+// Reads SD-ELEMENTs from b, keeping the params of l2met elements.
+// Returns the bytes following the structured data.
+func parseSD(b []byte, params map[string][]string) ([]byte, error) {
+	errSD := errors.New("syslog: malformed structured data")
+	for len(b) > 0 && b[0] == '[' {
+		i := 1
+		for i < len(b) && b[i] != ' ' && b[i] != ']' {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errSD
+		}
+		id := string(b[1:i])
+		keep := id == syslogSDID || strings.HasPrefix(id, syslogSDID+"@")
+		for {
+			for i < len(b) && b[i] == ' ' {
+				i++
+			}
+			if i >= len(b) {
+				return nil, errSD
+			}
+			if b[i] == ']' {
+				i++
+				break
+			}
+			eq := bytes.IndexByte(b[i:], '=')
+			if eq < 1 || i+eq+1 >= len(b) || b[i+eq+1] != '"' {
+				return nil, errSD
+			}
+			name := string(b[i : i+eq])
+			i += eq + 2
+			var val []byte
+			for ; i < len(b) && b[i] != '"'; i++ {
+				if b[i] == '\\' && i+1 < len(b) {
+					i++
+				}
+				val = append(val, b[i])
+			}
+			if i >= len(b) {
+				return nil, errSD
+			}
+			i++
+			if keep {
+				params[name] = append(params[name], string(val))
+			}
+		}
+		b = b[i:]
+	}
+	return b, nil
+}
+
+// RFC3164 messages look like: Mmm dd hh:mm:ss host tag[pid]: msg
+// The timestamp has no year or zone so we assume UTC and the
+// year which places the message closest to now.
+func parse3164(pri, rest []byte, now time.Time) (*SyslogMessage, error) {
+	hdr := &lpx.Header{
+		PrivalVersion: pri,
+		Time:          []byte("-"),
+		Procid:        []byte("-"),
+		Msgid:         []byte("-"),
+	}
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		t, err := time.Parse(time.Stamp, string(rest[:len(time.Stamp)]))
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.AddDate(0, 0, 1)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			hdr.Time = []byte(t.Format(time.RFC3339))
+			rest = rest[len(time.Stamp)+1:]
+		}
+	}
+	hdr.Hostname, rest = nextField(rest)
+	i := 0
+	for i < len(rest) && rest[i] != ':' && rest[i] != '[' && rest[i] != ' ' {
+		i++
+	}
+	hdr.Name, rest = rest[:i], rest[i:]
+	if len(rest) > 0 && rest[0] == '[' {
+		if end := bytes.IndexByte(rest, ']'); end > 0 {
+			hdr.Procid, rest = rest[1:end], rest[end+1:]
+		}
+	}
+	rest = bytes.TrimPrefix(rest, []byte(":"))
+	rest = bytes.TrimPrefix(rest, []byte(" "))
+	return &SyslogMessage{
+		Header: hdr,
+		Params: make(map[string][]string),
+		Msg:    rest,
+	}, nil
+}
+
+func nextField(b []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		return b, nil
+	}
+	return b[:i], b[i+1:]
+}
+
+// Runs a single syslog message through the same tuple
+// handlers used for logplex bodies.
+func BuildSyslogBuckets(m *SyslogMessage, opts options, mc *metchan.Channel) <-chan *bucket.Bucket {
+	p := new(parser)
+	p.mchan = mc
+	p.opts = opts
+	p.out = make(chan *bucket.Bucket)
+	p.ld = NewLogData()
+	p.hdr = m.Header
+	p.msg = m.Msg
+	go func() {
+		defer close(p.out)
+		p.handle()
+	}()
+	return p.out
+}
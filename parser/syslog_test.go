@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/metchan"
+)
+
+var syslogTest = []struct {
+	tname  string
+	in     string
+	procid string
+	auth   string
+	names  []string
+}{
+	{
+		"rfc5424 without structured data",
+		"<174>1 2013-07-22T00:06:26-00:00 somehost app web.1 - - measure#hello=1 count#world\n",
+		"web.1",
+		"",
+		[]string{"hello", "world"},
+	},
+	{
+		"rfc5424 with l2met structured data",
+		`<174>1 2013-07-22T00:06:26-00:00 somehost app web.1 - [meta x="y"][l2met@53595 auth="abc\"123"] measure#hello=1`,
+		"web.1",
+		`abc"123`,
+		[]string{"hello"},
+	},
+	{
+		"rfc3164",
+		"<13>Jul 22 00:06:26 somehost app[123]: measure#hello=1",
+		"123",
+		"",
+		[]string{"hello"},
+	},
+	{
+		"rfc3164 without pid",
+		"<13>Jul 22 00:06:26 somehost app: sample#hello=1",
+		"-",
+		"",
+		[]string{"hello"},
+	},
+}
+
+func TestParseSyslog(t *testing.T) {
+	for _, tc := range syslogTest {
+		m, err := ParseSyslog([]byte(tc.in))
+		if err != nil {
+			t.Fatalf("test=%s error=%s\n", tc.tname, err)
+		}
+		if string(m.Header.Procid) != tc.procid {
+			t.Errorf("test=%s actual-procid=%s expected-procid=%s\n",
+				tc.tname, m.Header.Procid, tc.procid)
+		}
+		if len(tc.auth) > 0 && (len(m.Params["auth"]) != 1 || m.Params["auth"][0] != tc.auth) {
+			t.Errorf("test=%s actual-auth=%v expected-auth=%s\n",
+				tc.tname, m.Params["auth"], tc.auth)
+		}
+		opts := options{"auth": []string{"abc123"}}
+		buckets := make([]*bucket.Bucket, 0)
+		for b := range BuildSyslogBuckets(m, opts, new(metchan.Channel)) {
+			buckets = append(buckets, b)
+		}
+		if len(buckets) != len(tc.names) {
+			t.Fatalf("test=%s actual-len=%d expected-len=%d\n",
+				tc.tname, len(buckets), len(tc.names))
+		}
+		for i := range tc.names {
+			if buckets[i].Id.Name != tc.names[i] {
+				t.Errorf("test=%s actual-name=%s expected-name=%s\n",
+					tc.tname, buckets[i].Id.Name, tc.names[i])
+			}
+		}
+	}
+}
+
+func TestParseSyslogMalformed(t *testing.T) {
+	for _, in := range []string{"", "hello", "<174", "<174>1 2013-07-22T00:06:26-00:00 host"} {
+		if _, err := ParseSyslog([]byte(in)); err == nil {
+			t.Errorf("input=%q expected error\n", in)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// The pipeline pkg runs l2met's aggregation inside another
+// Go program. A Pipeline parses log bodies into buckets, keeps
+// them in a store and hands finished buckets to its outlets,
+// just like the l2met command but without flags or HTTP.
+//
+//	cfg := conf.Defaults()
+//	st := store.NewMemStore()
+//	rdr := reader.New(cfg, st)
+//	dd := outlet.NewDataDogOutlet(cfg, rdr.Subscribe("datadog", cfg.BufferSize))
+//	p := pipeline.New(cfg, st, rdr, dd)
+//	p.Ingest(body, map[string][]string{"auth": {encrypted}})
+//	p.Close()
+//
+// Histogram buckets, percentiles and the quantile method come
+// from the parser and bucket package defaults; set those before
+// building a Pipeline to change them.
+package pipeline
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/reader"
+	"github.com/DataDog/l2met/receiver"
+	"github.com/DataDog/l2met/store"
+)
+
+// Anything that reads finished buckets from a subscription to
+// the reader. The outlets in the outlet pkg all satisfy this
+// interface.
+type Outlet interface {
+	Start(ctx context.Context)
+	Stop()
+}
+
+var ErrClosed = errors.New("pipeline: closed")
+
+type Pipeline struct {
+	recv    *receiver.Receiver
+	rdr     *reader.Reader
+	outlets []Outlet
+	mchan   *metchan.Channel
+	cancel  context.CancelFunc
+}
+
+// Builds a pipeline and starts the receiver, the reader and the
+// outlets. The internal metrics channel is enabled if
+// cfg.MetchanUrl is set. The reader must scan st, and the
+// outlets must have subscribed to it, for buckets to reach them.
+func New(cfg *conf.D, st store.Store, rdr *reader.Reader, outlets ...Outlet) *Pipeline {
+	p := &Pipeline{rdr: rdr, outlets: outlets}
+	ctx := context.Background()
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.mchan = metchan.New(cfg)
+	p.mchan.Start(ctx)
+	p.recv = receiver.NewReceiver(cfg, st)
+	p.recv.Mchan = p.mchan
+	p.recv.Start(ctx)
+	for _, o := range p.outlets {
+		o.Start(ctx)
+	}
+	p.rdr.Mchan = p.mchan
+	p.rdr.Start(ctx)
+	return p
+}
+
+// Parses a logplex formatted body. The opts are the same as
+// the query options on a drain URL and must include the
+// encrypted credential in auth. Parsing happens asynchronously;
+// Ingest returns ErrClosed once the pipeline is closed, and
+// receiver.ErrInboxFull if parsing has fallen behind for longer
+// than cfg.ReceiverWait.
+func (p *Pipeline) Ingest(body []byte, opts map[string][]string) error {
+	err := p.recv.Receive(body, opts)
+	if err == receiver.ErrStopped {
+		return ErrClosed
+	}
+	return err
+}
+
+// Drains everything that has been ingested into the store and
+// lets the outlets deliver the buckets that are ready. Buckets
+// whose interval has not ended stay in the store.
+func (p *Pipeline) Close() error {
+	p.recv.Stop()
+	p.rdr.Stop()
+	for _, o := range p.outlets {
+		o.Stop()
+	}
+	p.mchan.Stop()
+	p.cancel()
+	return nil
+}
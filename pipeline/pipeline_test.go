@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/reader"
+	"github.com/DataDog/l2met/store"
+)
+
+// Collects the buckets delivered to its subscription.
+type testOutlet struct {
+	inbox   <-chan *bucket.Bucket
+	buckets []*bucket.Bucket
+	done    chan struct{}
+}
+
+func (o *testOutlet) Start(ctx context.Context) {
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		for b := range o.inbox {
+			o.buckets = append(o.buckets, b)
+		}
+	}()
+}
+
+func (o *testOutlet) Stop() {
+	<-o.done
+}
+
+func TestPipeline(t *testing.T) {
+	cfg := conf.Defaults()
+	cfg.ReceiverDeadline = 5
+	st := store.NewMemStore()
+	rdr := reader.New(cfg, st)
+	o := &testOutlet{inbox: rdr.Subscribe("test", 10)}
+	p := New(cfg, st, rdr, o)
+
+	// Old enough that the interval has ended by Close.
+	ts := time.Now().Add(-3 * time.Second).UTC().Format(time.RFC3339)
+	line := fmt.Sprintf("<174>1 %s somehost name test - measure#a=1 measure#a=3", ts)
+	body := []byte(fmt.Sprintf("%d %s", len(line), line))
+	opts := map[string][]string{
+		"auth":       []string{"abc123"},
+		"resolution": []string{"1"},
+	}
+	if err := p.Ingest(body, opts); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	if len(o.buckets) != 1 {
+		t.Fatalf("actual-len=%d expected-len=1\n", len(o.buckets))
+	}
+	b := o.buckets[0]
+	if b.Id.Name != "a" || b.Count() != 2 || b.Sum != 4 {
+		t.Errorf("actual=%s expected name=a count=2 sum=4\n", b)
+	}
+	if err := p.Ingest(body, opts); err != ErrClosed {
+		t.Errorf("actual-err=%v expected-err=%v\n", err, ErrClosed)
+	}
+}
@@ -1,12 +1,15 @@
 // The reader pkg is responsible for reading data from
-// the store, building buckets from the data, and placing
-// the buckets into a user-supplied channel.
+// the store, building buckets from the data, and copying
+// the buckets to every outlet that subscribed.
 package reader
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/DataDog/l2met/auth"
 	"github.com/DataDog/l2met/bucket"
 	"github.com/DataDog/l2met/conf"
 	"github.com/DataDog/l2met/metchan"
@@ -18,8 +21,30 @@ type Reader struct {
 	scanInterval time.Duration
 	numOutlets   int
 	Inbox        chan *bucket.Bucket
-	Outbox       chan *bucket.Bucket
-	Mchan        *metchan.Channel
+	subs         []subscription
+	// Credentials name the outlet their buckets go to.
+	creds auth.Cache
+	Mchan *metchan.Channel
+	// Signals the scan routine that scanInterval changed.
+	reset  chan struct{}
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	// Tracks the outlet routines so that the
+	// subscriptions are closed once they drain.
+	outleting sync.WaitGroup
+}
+
+// An outlet's own buffer of buckets. With more than one
+// subscriber, buckets are sent to in and queued in memory
+// until out has room, so a brief burst neither loses buckets
+// nor holds up the other outlets. The queue holds as many
+// buckets as out does; past that the oldest are dropped so a
+// stuck outlet can't exhaust memory.
+type subscription struct {
+	name string
+	in   chan *bucket.Bucket
+	out  chan *bucket.Bucket
 }
 
 // Sets the scan interval to 1s.
@@ -28,40 +53,176 @@ func New(cfg *conf.D, st store.Store) *Reader {
 	rdr.Inbox = make(chan *bucket.Bucket, cfg.BufferSize)
 	rdr.numOutlets = cfg.Concurrency
 	rdr.scanInterval = cfg.OutletInterval
+	rdr.reset = make(chan struct{}, 1)
 	rdr.str = st
 	return rdr
 }
 
-func (r *Reader) Start(out chan *bucket.Bucket) {
-	r.Outbox = out
-	go r.scan()
+// Returns a channel that receives the buckets read from the
+// store, buffering up to size of them. Buckets whose credential
+// names a backend only go to the subscriber of that name. When
+// the buffer is full, up to size further buckets queue up for this
+// subscriber alone so that a slow outlet doesn't hold up the others;
+// beyond that its oldest buckets are dropped. A lone subscriber is
+// waited on instead. The channel is closed once the reader has
+// stopped and every bucket has been received.
+// Subscribe must be called before Start.
+func (r *Reader) Subscribe(name string, size int) <-chan *bucket.Bucket {
+	out := make(chan *bucket.Bucket, size)
+	r.subs = append(r.subs, subscription{name: name, in: out, out: out})
+	return out
+}
+
+// Scans the store until ctx is done or Stop is called.
+func (r *Reader) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	if len(r.subs) > 1 {
+		for i := range r.subs {
+			r.subs[i].in = make(chan *bucket.Bucket)
+			go r.queue(r.subs[i])
+		}
+	}
 	for i := 0; i < r.numOutlets; i++ {
+		r.outleting.Add(1)
 		go r.outlet()
 	}
+	go r.scan(ctx)
+}
+
+// Runs a final scan so that buckets which are ready get
+// delivered, then closes the subscriptions once they have
+// been read from the store.
+func (r *Reader) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+// Changes how often the store is scanned. Takes
+// effect immediately if the reader is running.
+func (r *Reader) SetInterval(d time.Duration) {
+	r.mu.Lock()
+	r.scanInterval = d
+	r.mu.Unlock()
+	select {
+	case r.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Applies the scan interval setting from cfg.
+func (r *Reader) Reload(cfg *conf.D) {
+	r.SetInterval(cfg.OutletInterval)
+}
+
+func (r *Reader) interval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.scanInterval
 }
 
-func (r *Reader) scan() {
-	for _ = range time.Tick(r.scanInterval) {
-		startScan := time.Now()
-		buckets, err := r.str.Scan(r.str.Now().Truncate(time.Second))
-		if err != nil {
-			fmt.Printf("at=bucket.scan error=%s\n", err)
+func (r *Reader) scan(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+	// The last pass happens after ctx is done so that
+	// buckets which became ready meanwhile are delivered.
+	for stopping := false; !stopping; {
+		select {
+		case <-ticker.C:
+		case <-r.reset:
+			ticker.Reset(r.interval())
 			continue
+		case <-ctx.Done():
+			stopping = true
 		}
-		i := 0
-		for b := range buckets {
-			r.Inbox <- b
-			i++
-		}
-		r.Mchan.Time("reader.scan", startScan)
+		r.scanOnce()
 	}
+	close(r.Inbox)
+	r.outleting.Wait()
+	for _, s := range r.subs {
+		close(s.in)
+	}
+}
+
+func (r *Reader) scanOnce() {
+	startScan := time.Now()
+	buckets, err := r.str.Scan(r.str.Now().Truncate(time.Second))
+	if err != nil {
+		fmt.Printf("at=bucket.scan error=%s\n", err)
+		return
+	}
+	for b := range buckets {
+		r.Inbox <- b
+	}
+	r.Mchan.Time("reader.scan", startScan)
 }
 
 func (r *Reader) outlet() {
+	defer r.outleting.Done()
 	for b := range r.Inbox {
 		startGet := time.Now()
 		r.str.Get(b)
-		r.Outbox <- b
 		r.Mchan.Time("reader.get", startGet)
+		r.publish(b)
+	}
+}
+
+func (r *Reader) publish(b *bucket.Bucket) {
+	// Bad credentials are dropped by the outlets.
+	if c, err := r.creds.Get(b.Id.Auth); err == nil && len(c.Backend) > 0 {
+		for _, s := range r.subs {
+			if s.name == c.Backend {
+				s.in <- b
+				return
+			}
+		}
+		r.Mchan.Measure("reader.unrouted", 1)
+		return
+	}
+	for _, s := range r.subs {
+		s.in <- b
+	}
+}
+
+// Moves buckets from s.in to s.out, holding up to cap(s.out)
+// of them in memory while s.out is full. Closes s.out once s.in
+// is closed and every queued bucket has been delivered.
+func (r *Reader) queue(s subscription) {
+	defer close(s.out)
+	limit := cap(s.out)
+	if limit < 1 {
+		limit = 1
+	}
+	var pending []*bucket.Bucket
+	in := s.in
+	for in != nil || len(pending) > 0 {
+		// A nil channel is never ready, so nothing is
+		// sent while the queue is empty.
+		var out chan *bucket.Bucket
+		var next *bucket.Bucket
+		if len(pending) > 0 {
+			out = s.out
+			next = pending[0]
+		}
+		select {
+		case b, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if len(pending) >= limit {
+				pending[0] = nil
+				pending = pending[1:]
+				r.Mchan.Measure(s.name+"-outlet.inbox.drop", 1)
+			}
+			pending = append(pending, b)
+			if len(pending) > 1 {
+				r.Mchan.Measure(s.name+"-outlet.inbox.backlog", float64(len(pending)))
+			}
+		case out <- next:
+			pending[0] = nil
+			pending = pending[1:]
+		}
 	}
 }
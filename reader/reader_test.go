@@ -0,0 +1,256 @@
+package reader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/store"
+	"github.com/kr/fernet"
+)
+
+func TestStopDeliversReadyBuckets(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:    2,
+		BufferSize:     10,
+		OutletInterval: time.Hour,
+	}
+	st := store.NewMemStore()
+	id := &bucket.Id{
+		Name:       "a",
+		Type:       "counter",
+		Resolution: time.Second,
+		Time:       time.Now().Add(-time.Minute).Truncate(time.Second),
+	}
+	st.Put(&bucket.Bucket{Id: id, Sum: 1})
+
+	// Start and stop twice to make sure the reader can be
+	// torn down and a new one built against the same store.
+	for i, expected := range []int{1, 0} {
+		rdr := New(cfg, st)
+		rdr.Mchan = new(metchan.Channel)
+		out := rdr.Subscribe("test", 10)
+		rdr.Start(context.Background())
+		rdr.Stop()
+		n := 0
+		// The subscription is closed by Stop, so this terminates.
+		for _ = range out {
+			n++
+		}
+		if n != expected {
+			t.Errorf("run=%d actual=%d expected=%d\n", i, n, expected)
+		}
+	}
+}
+
+func TestCancelStopsReader(t *testing.T) {
+	cfg := &conf.D{Concurrency: 1, BufferSize: 1, OutletInterval: time.Hour}
+	rdr := New(cfg, store.NewMemStore())
+	rdr.Mchan = new(metchan.Channel)
+	out := rdr.Subscribe("test", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	rdr.Start(ctx)
+	cancel()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatalf("expected closed subscription\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("reader did not stop after cancel\n")
+	}
+}
+
+func TestSetInterval(t *testing.T) {
+	cfg := &conf.D{Concurrency: 1, BufferSize: 10, OutletInterval: time.Hour}
+	st := store.NewMemStore()
+	rdr := New(cfg, st)
+	rdr.Mchan = new(metchan.Channel)
+	out := rdr.Subscribe("test", 10)
+	rdr.Start(context.Background())
+	defer rdr.Stop()
+	rdr.SetInterval(10 * time.Millisecond)
+	id := &bucket.Id{
+		Name:       "a",
+		Type:       "counter",
+		Resolution: time.Second,
+		Time:       time.Now().Add(-time.Minute).Truncate(time.Second),
+	}
+	st.Put(&bucket.Bucket{Id: id, Sum: 1})
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Fatalf("bucket not delivered after shortening the interval\n")
+	}
+}
+
+func TestSubscribersShareOneScan(t *testing.T) {
+	cfg := &conf.D{Concurrency: 2, BufferSize: 10, OutletInterval: time.Hour}
+	st := store.NewMemStore()
+	const numBuckets = 20
+	for i := 0; i < numBuckets; i++ {
+		id := &bucket.Id{
+			Name:       fmt.Sprintf("m%d", i),
+			Type:       "counter",
+			Resolution: time.Second,
+			Time:       time.Now().Add(-time.Minute).Truncate(time.Second),
+		}
+		st.Put(&bucket.Bucket{Id: id, Sum: 1})
+	}
+	rdr := New(cfg, st)
+	rdr.Mchan = new(metchan.Channel)
+	// Nothing reads from either subscription until the reader has
+	// stopped, so both hold twice as many buckets as their buffers.
+	a := rdr.Subscribe("a", numBuckets/2)
+	b := rdr.Subscribe("b", numBuckets/2)
+	rdr.Start(context.Background())
+	rdr.Stop()
+	for _, c := range []struct {
+		name string
+		out  <-chan *bucket.Bucket
+	}{
+		{"a", a},
+		{"b", b},
+	} {
+		seen := make(map[string]bool)
+		for b := range c.out {
+			seen[b.Id.Name] = true
+		}
+		if len(seen) != numBuckets {
+			t.Errorf("subscriber=%s actual=%d expected=%d\n", c.name, len(seen), numBuckets)
+		}
+	}
+}
+
+func TestSlowSubscriberDropsOldest(t *testing.T) {
+	cfg := &conf.D{Concurrency: 1, BufferSize: 10, OutletInterval: time.Hour}
+	st := store.NewMemStore()
+	const numBuckets = 20
+	for i := 0; i < numBuckets; i++ {
+		id := &bucket.Id{
+			Name:       fmt.Sprintf("m%d", i),
+			Type:       "counter",
+			Resolution: time.Second,
+			Time:       time.Now().Add(-time.Minute).Truncate(time.Second),
+		}
+		st.Put(&bucket.Bucket{Id: id, Sum: 1})
+	}
+	rdr := New(cfg, st)
+	mchan := new(metchan.Channel)
+	mchan.Enabled = true
+	mchan.Buffer = make(map[string]*bucket.Bucket)
+	mchan.FlushInterval = time.Hour
+	rdr.Mchan = mchan
+	fast := rdr.Subscribe("fast", numBuckets)
+	// Holds 2 buckets in its buffer and 2 in its queue.
+	slow := rdr.Subscribe("slow", 2)
+	rdr.Start(context.Background())
+	rdr.Stop()
+	for _, c := range []struct {
+		name     string
+		out      <-chan *bucket.Bucket
+		expected int
+	}{
+		{"fast", fast, numBuckets},
+		{"slow", slow, 4},
+	} {
+		n := 0
+		for _ = range c.out {
+			n++
+		}
+		if n != c.expected {
+			t.Errorf("subscriber=%s actual=%d expected=%d\n", c.name, n, c.expected)
+		}
+	}
+	drops := 0
+	for _, b := range mchan.Buffer {
+		if strings.HasSuffix(b.Id.Name, "slow-outlet.inbox.drop") {
+			drops += b.Count()
+		}
+	}
+	if drops != numBuckets-4 {
+		t.Errorf("actual-drops=%d expected-drops=%d\n", drops, numBuckets-4)
+	}
+}
+
+func TestCredentialsRouteBuckets(t *testing.T) {
+	var k fernet.Key
+	if err := auth.SetKeys([]string{k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.D{Concurrency: 1, BufferSize: 10, OutletInterval: time.Hour}
+	st := store.NewMemStore()
+	for _, creds := range []string{
+		"plain-key",
+		`{"backend": "b", "key": "routed"}`,
+		`{"backend": "b", "key": "other"}`,
+	} {
+		tok, err := auth.EncryptAndSign([]byte(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := &bucket.Id{
+			Name:       "a",
+			Type:       "counter",
+			Auth:       string(tok),
+			Resolution: time.Second,
+			Time:       time.Now().Add(-time.Minute).Truncate(time.Second),
+		}
+		st.Put(&bucket.Bucket{Id: id, Sum: 1})
+	}
+	rdr := New(cfg, st)
+	rdr.Mchan = new(metchan.Channel)
+	a := rdr.Subscribe("a", 10)
+	b := rdr.Subscribe("b", 10)
+	rdr.Start(context.Background())
+	rdr.Stop()
+	// Bare keys go to every outlet, documents to their backend.
+	for _, c := range []struct {
+		name     string
+		out      <-chan *bucket.Bucket
+		expected int
+	}{
+		{"a", a, 1},
+		{"b", b, 3},
+	} {
+		n := 0
+		for _ = range c.out {
+			n++
+		}
+		if n != c.expected {
+			t.Errorf("subscriber=%s actual=%d expected=%d\n", c.name, n, c.expected)
+		}
+	}
+}
+
+func TestPublishKeepsValueOrder(t *testing.T) {
+	cfg := &conf.D{Concurrency: 1, BufferSize: 10, OutletInterval: time.Hour}
+	st := store.NewMemStore()
+	id := &bucket.Id{
+		Name:       "load",
+		Type:       "sample",
+		Resolution: time.Second,
+		Time:       time.Now().Add(-time.Minute).Truncate(time.Second),
+	}
+	st.Put(&bucket.Bucket{Id: id, Vals: []float64{3, 5, 1}, Sum: 9})
+	rdr := New(cfg, st)
+	rdr.Mchan = new(metchan.Channel)
+	a := rdr.Subscribe("a", 10)
+	b := rdr.Subscribe("b", 10)
+	rdr.Start(context.Background())
+	rdr.Stop()
+	// Samples report their most recent value.
+	for _, out := range []<-chan *bucket.Bucket{a, b} {
+		for bkt := range out {
+			if actual := *bkt.Metrics()[0].Val; actual != 1 {
+				t.Errorf("actual=%f expected=1\n", actual)
+			}
+		}
+	}
+}
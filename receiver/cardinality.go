@@ -0,0 +1,148 @@
+package receiver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+// Buckets over a cardinality limit are folded into
+// buckets with this name or source.
+const otherBucket = "other"
+
+// A user's interval at one resolution.
+type interval struct {
+	user       string
+	time       time.Time
+	resolution time.Duration
+}
+
+// The names and sources a user sent in one interval.
+type intervalSeen struct {
+	// Sources by metric name. Neither count the other bucket.
+	sources  map[string]map[string]bool
+	numNames int
+	// Limits and prefixes already logged this interval.
+	logged map[string]bool
+}
+
+// Limits the distinct metric names each user may send per
+// interval and the distinct sources per name, so that a bad
+// deploy putting request IDs in metric names can't create
+// unbounded buckets in the register and store.
+type cardinality struct {
+	sync.Mutex
+	maxNames, maxSources int
+	drop                 bool
+	deadline             int64
+	seen                 map[interval]*intervalSeen
+}
+
+func newCardinality(cfg *conf.D) *cardinality {
+	c := &cardinality{seen: make(map[interval]*intervalSeen)}
+	c.setConf(cfg)
+	return c
+}
+
+func (c *cardinality) setConf(cfg *conf.D) {
+	c.Lock()
+	defer c.Unlock()
+	c.maxNames = cfg.MaxNames
+	c.maxSources = cfg.MaxSources
+	c.drop = cfg.CardinalityOverflow == "drop"
+	c.deadline = cfg.ReceiverDeadline
+}
+
+func (c *cardinality) enabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.maxNames > 0 || c.maxSources > 0
+}
+
+// Records the bucket's name and source for the user. If that
+// exceeds a limit the name or source is replaced with other,
+// or false is returned when overflow is set to drop.
+func (c *cardinality) admit(user string, id *bucket.Id, mchan *metchan.Channel) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.maxNames <= 0 && c.maxSources <= 0 {
+		return true
+	}
+	k := interval{user, id.Time, id.Resolution}
+	s, ok := c.seen[k]
+	if !ok {
+		s = &intervalSeen{
+			sources: make(map[string]map[string]bool),
+			logged:  make(map[string]bool),
+		}
+		c.seen[k] = s
+	}
+
+	sources, ok := s.sources[id.Name]
+	if !ok && id.Name != otherBucket {
+		if c.maxNames > 0 && s.numNames >= c.maxNames {
+			if !c.overflow(s, "names", user, id, mchan) {
+				return false
+			}
+			id.Name = otherBucket
+			sources = s.sources[id.Name]
+		} else {
+			s.numNames++
+		}
+	}
+	if sources == nil {
+		sources = make(map[string]bool)
+		s.sources[id.Name] = sources
+	}
+
+	if !sources[id.Source] && id.Source != otherBucket {
+		n := len(sources)
+		if sources[otherBucket] {
+			n--
+		}
+		if c.maxSources > 0 && n >= c.maxSources {
+			if !c.overflow(s, "sources", user, id, mchan) {
+				return false
+			}
+			id.Source = otherBucket
+		}
+	}
+	sources[id.Source] = true
+	return true
+}
+
+// Counts the overflow and logs it once per limit and prefix
+// in the interval. Returns false if the bucket should be dropped.
+// Must be called with the lock held.
+func (c *cardinality) overflow(s *intervalSeen, limit, user string, id *bucket.Id, mchan *metchan.Channel) bool {
+	mchan.CountOverflow(user, limit)
+	prefix := strings.SplitN(id.Name, ".", 2)[0]
+	if !s.logged[limit+":"+prefix] {
+		s.logged[limit+":"+prefix] = true
+		max := c.maxNames
+		if limit == "sources" {
+			max = c.maxSources
+		}
+		fmt.Printf("at=cardinality-limit limit=%s max=%d user=%s prefix=%s drop=%t\n",
+			limit, max, user, prefix, c.drop)
+	}
+	return !c.drop
+}
+
+// Forgets intervals that are past the receiver's deadline,
+// since no more buckets will be admitted for them.
+func (c *cardinality) prune(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.seen {
+		end := k.time.Add(k.resolution * time.Duration(c.deadline+1))
+		if end.Before(now) {
+			delete(c.seen, k)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/bucket"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+func TestCardinality(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	cases := []struct {
+		overflow       string
+		user           string
+		name, source   string
+		expectedName   string
+		expectedSource string
+		expectedOk     bool
+	}{
+		{"other", "a", "web.1", "x", "web.1", "x", true},
+		{"other", "a", "web.2", "x", "web.2", "x", true},
+		{"other", "a", "web.1", "x", "web.1", "x", true},
+		{"other", "a", "web.3", "x", "other", "x", true},
+		{"other", "a", "web.4", "y", "other", "y", true},
+		{"other", "a", "web.1", "y", "web.1", "y", true},
+		{"other", "a", "web.1", "z", "web.1", "other", true},
+		{"other", "a", "other", "z", "other", "other", true},
+		// Limits are per user.
+		{"other", "b", "web.3", "x", "web.3", "x", true},
+		{"drop", "a", "web.5", "x", "web.5", "x", false},
+		{"drop", "a", "web.2", "z", "web.2", "z", true},
+		{"drop", "a", "web.2", "w", "web.2", "w", false},
+	}
+	c := newCardinality(&conf.D{MaxNames: 2, MaxSources: 2})
+	for i, tc := range cases {
+		c.setConf(&conf.D{MaxNames: 2, MaxSources: 2, CardinalityOverflow: tc.overflow})
+		id := &bucket.Id{Name: tc.name, Source: tc.source, Time: now, Resolution: time.Minute}
+		ok := c.admit(tc.user, id, new(metchan.Channel))
+		if ok != tc.expectedOk {
+			t.Errorf("case=%d actual-ok=%t expected-ok=%t\n", i, ok, tc.expectedOk)
+		}
+		if ok && (id.Name != tc.expectedName || id.Source != tc.expectedSource) {
+			t.Errorf("case=%d actual=%s,%s expected=%s,%s\n",
+				i, id.Name, id.Source, tc.expectedName, tc.expectedSource)
+		}
+	}
+
+	// The next interval starts over.
+	id := &bucket.Id{Name: "web.9", Time: now.Add(time.Minute), Resolution: time.Minute}
+	if !c.admit("a", id, nil) || id.Name != "web.9" {
+		t.Errorf("actual=%s expected=web.9\n", id.Name)
+	}
+	c.prune(now.Add(3 * time.Minute))
+	if len(c.seen) != 0 {
+		t.Errorf("actual-len=%d expected-len=0\n", len(c.seen))
+	}
+}
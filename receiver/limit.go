@@ -0,0 +1,150 @@
+package receiver
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DataDog/l2met/conf"
+)
+
+// Allows up to burst events at once, refilling at rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBucket) refill(now time.Time, rate, burst float64) {
+	t.tokens = math.Min(burst, t.tokens+now.Sub(t.last).Seconds()*rate)
+	t.last = now
+}
+
+// Time until the bucket holds a whole token again.
+func (t *tokenBucket) wait(rate float64) time.Duration {
+	if t.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - t.tokens) / rate * float64(time.Second))
+}
+
+// Per-user token buckets for HTTP requests and for new
+// buckets in the register. Users are the decrypted
+// credentials, without any password.
+type limiter struct {
+	sync.Mutex
+	cfg      *conf.D
+	requests map[string]*tokenBucket
+	buckets  map[string]*tokenBucket
+}
+
+func newLimiter(cfg *conf.D) *limiter {
+	return &limiter{
+		cfg:      cfg,
+		requests: make(map[string]*tokenBucket),
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// Applies new limits. Users keep their remaining tokens.
+func (l *limiter) setConf(cfg *conf.D) {
+	l.Lock()
+	defer l.Unlock()
+	l.cfg = cfg
+}
+
+func burst(rate float64, b int) float64 {
+	if b > 0 {
+		return float64(b)
+	}
+	return math.Max(1, rate)
+}
+
+// Must be called with the lock held.
+func (l *limiter) get(m map[string]*tokenBucket, user string, now time.Time, rate, b float64) *tokenBucket {
+	t, ok := m[user]
+	if !ok {
+		t = &tokenBucket{tokens: b, last: now}
+		m[user] = t
+	}
+	t.refill(now, rate, b)
+	return t
+}
+
+// Takes a request token from the user. Requests are also
+// refused while the user has no new buckets left, since
+// their data would be dropped. When the request is refused
+// it returns how long the user should wait.
+func (l *limiter) allowRequest(user string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	rl := l.cfg.RateLimitFor(user)
+	if rl.Buckets > 0 {
+		b := burst(rl.Buckets, rl.BucketBurst)
+		t := l.get(l.buckets, user, now, rl.Buckets, b)
+		if t.tokens < 1 {
+			return false, t.wait(rl.Buckets)
+		}
+	}
+	if rl.Requests > 0 {
+		b := burst(rl.Requests, rl.RequestBurst)
+		t := l.get(l.requests, user, now, rl.Requests, b)
+		if t.tokens < 1 {
+			return false, t.wait(rl.Requests)
+		}
+		t.tokens--
+	}
+	return true, 0
+}
+
+// Takes a token for a new bucket from the user.
+func (l *limiter) allowBucket(user string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	rl := l.cfg.RateLimitFor(user)
+	if rl.Buckets <= 0 {
+		return true
+	}
+	t := l.get(l.buckets, user, now, rl.Buckets, burst(rl.Buckets, rl.BucketBurst))
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// Reports whether any user has a bucket limit, so callers
+// can skip decrypting credentials when none do.
+func (l *limiter) limitsBuckets() bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.cfg.RateLimit.Buckets > 0 {
+		return true
+	}
+	for _, rl := range l.cfg.RateLimits {
+		if rl.Buckets > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Forgets users whose token buckets have refilled,
+// as they would start out full anyway.
+func (l *limiter) prune(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for user, t := range l.requests {
+		rl := l.cfg.RateLimitFor(user)
+		t.refill(now, rl.Requests, burst(rl.Requests, rl.RequestBurst))
+		if rl.Requests <= 0 || t.tokens >= burst(rl.Requests, rl.RequestBurst) {
+			delete(l.requests, user)
+		}
+	}
+	for user, t := range l.buckets {
+		rl := l.cfg.RateLimitFor(user)
+		t.refill(now, rl.Buckets, burst(rl.Buckets, rl.BucketBurst))
+		if rl.Buckets <= 0 || t.tokens >= burst(rl.Buckets, rl.BucketBurst) {
+			delete(l.buckets, user)
+		}
+	}
+}
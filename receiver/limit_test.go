@@ -0,0 +1,139 @@
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+)
+
+func TestLimiter(t *testing.T) {
+	cfg := &conf.D{
+		RateLimit: conf.RateLimit{Requests: 1, RequestBurst: 2, Buckets: 2},
+		RateLimits: map[string]conf.RateLimit{
+			"big": conf.RateLimit{Requests: 100},
+		},
+	}
+	now := time.Now()
+	l := newLimiter(cfg)
+	cases := []struct {
+		user    string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{"small", 0, true},
+		{"small", 0, true},
+		{"small", 0, false},
+		{"big", 0, true},
+		{"big", 0, true},
+		{"big", 0, true},
+		{"small", time.Second, true},
+		{"small", 0, false},
+	}
+	for i, c := range cases {
+		now = now.Add(c.elapsed)
+		ok, wait := l.allowRequest(c.user, now)
+		if ok != c.allowed {
+			t.Errorf("case=%d user=%s actual=%t expected=%t\n", i, c.user, ok, c.allowed)
+		}
+		if !ok && wait <= 0 {
+			t.Errorf("case=%d expected a positive wait\n", i)
+		}
+	}
+
+	// Once the new bucket allowance is spent,
+	// requests are refused until it refills.
+	if !l.allowBucket("big", now) || !l.allowBucket("big", now) {
+		t.Fatalf("expected 2 buckets to be allowed\n")
+	}
+	if l.allowBucket("big", now) {
+		t.Errorf("expected third bucket to be refused\n")
+	}
+	if ok, _ := l.allowRequest("big", now); ok {
+		t.Errorf("expected request to be refused without buckets left\n")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.allowRequest("big", now); !ok {
+		t.Errorf("expected request to be allowed after refill\n")
+	}
+
+	l.prune(now.Add(time.Minute))
+	if len(l.requests) != 0 || len(l.buckets) != 0 {
+		t.Errorf("actual=%d,%d expected refilled users to be pruned\n",
+			len(l.requests), len(l.buckets))
+	}
+}
+
+func TestServeHTTPRateLimit(t *testing.T) {
+	header := basicAuth(t, "app:pass")
+
+	cfg := &conf.D{
+		BufferSize: 10,
+		RateLimit:  conf.RateLimit{Requests: 0.5},
+	}
+	recv := NewReceiver(cfg, nil)
+	recv.Mchan = new(metchan.Channel)
+	codes := make([]int, 2)
+	var retryAfter string
+	for i := range codes {
+		req := httptest.NewRequest("POST", "/logs", strings.NewReader(""))
+		req.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		recv.ServeHTTP(w, req)
+		codes[i] = w.Code
+		retryAfter = w.Header().Get("Retry-After")
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("actual=%v expected=[200 429]\n", codes)
+	}
+	if retryAfter != "2" {
+		t.Errorf("actual-retry-after=%q expected=2\n", retryAfter)
+	}
+}
+
+func TestListenerRateLimit(t *testing.T) {
+	// Installs a key for the token below.
+	basicAuth(t, "app:pass")
+	tok, err := auth.EncryptAndSign([]byte("app:pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := map[string][]string{"auth": []string{string(tok)}}
+	for _, c := range []struct {
+		name    string
+		receive func(r *Receiver, msg string)
+		msg     string
+	}{
+		{"statsd", func(r *Receiver, msg string) { r.receiveStatsd([]byte(msg), opts) }, "%s:1|c"},
+		{"syslog", func(r *Receiver, msg string) { r.receiveSyslog([]byte(msg), opts) },
+			"<174>1 " + time.Now().UTC().Format(time.RFC3339) + " somehost app web.1 - - measure#%s=1"},
+	} {
+		cfg := &conf.D{
+			ReceiverDeadline: 2,
+			RateLimit:        conf.RateLimit{Requests: 0.5},
+		}
+		recv := NewReceiver(cfg, nil)
+		recv.Mchan = new(metchan.Channel)
+		c.receive(recv, fmt.Sprintf(c.msg, "a"))
+		c.receive(recv, fmt.Sprintf(c.msg, "b"))
+		if n := len(recv.Register.m); n != 1 {
+			t.Errorf("listener=%s actual-buckets=%d expected=1\n", c.name, n)
+		}
+	}
+}
+
+func TestServeHTTPMissingAuth(t *testing.T) {
+	recv := NewReceiver(&conf.D{BufferSize: 1}, nil)
+	recv.Mchan = new(metchan.Channel)
+	w := httptest.NewRecorder()
+	recv.ServeHTTP(w, httptest.NewRequest("POST", "/logs", strings.NewReader("")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("actual=%d expected=400\n", w.Code)
+	}
+}
@@ -6,10 +6,14 @@ package receiver
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,8 +42,19 @@ type LogRequest struct {
 type register struct {
 	sync.Mutex
 	m map[bucket.Id]*bucket.Bucket
+	// Set by the final transfer. Buckets that
+	// arrive afterwards are dropped.
+	closed bool
 }
 
+var (
+	// Returned by Receive once the receiver has been stopped.
+	ErrStopped = errors.New("receiver: stopped")
+	// Returned by Receive when the inbox stays full
+	// for longer than the configured wait.
+	ErrInboxFull = errors.New("receiver: inbox full")
+)
+
 type Receiver struct {
 	// Keeping a register allows us to aggregate buckets in memory.
 	// This decouples redis writes from HTTP requests.
@@ -63,9 +78,32 @@ type Receiver struct {
 	// The number of time units allowed to pass before dropping a
 	// log line.
 	deadline int64
+	// How long Receive waits for room in the inbox.
+	// Read and written atomically so Reload can change it.
+	wait int64
 	// Publish receiver metrics on this channel.
 	Mchan    *metchan.Channel
 	inFlight sync.WaitGroup
+	// Guards the inbox against sends after Stop closes it.
+	inboxLock sync.RWMutex
+	stopped   bool
+	// Tracks the accept and outlet routines so that
+	// Stop can wait for them to drain.
+	accepting, outleting sync.WaitGroup
+	// Tracks the transfer and report routines.
+	background sync.WaitGroup
+	cancel     context.CancelFunc
+	done       chan struct{}
+	// Users of the credentials seen by the syslog
+	// listeners and the bucket limits.
+	auths       authCache
+	limits      *limiter
+	cardinality *cardinality
+	// Open syslog TCP connections, closed by Stop.
+	connsLock   sync.Mutex
+	conns       map[net.Conn]bool
+	connsDone   bool
+	connReaders sync.WaitGroup
 }
 
 func NewReceiver(cfg *conf.D, s store.Store) *Receiver {
@@ -76,24 +114,69 @@ func NewReceiver(cfg *conf.D, s store.Store) *Receiver {
 	r.FlushInterval = cfg.FlushInterval
 	r.NumOutlets = cfg.Concurrency
 	r.deadline = cfg.ReceiverDeadline
+	r.wait = int64(cfg.ReceiverWait)
 	r.numBuckets = uint64(0)
 	r.numReqs = uint64(0)
 	r.Store = s
+	r.limits = newLimiter(cfg)
+	r.cardinality = newCardinality(cfg)
+	r.conns = make(map[net.Conn]bool)
 	return r
 }
 
-func (r *Receiver) Receive(b []byte, opts map[string][]string) {
+// Applies the rate limits, cardinality limits and inbox
+// wait from cfg. Users keep the tokens they have left.
+func (r *Receiver) Reload(cfg *conf.D) {
+	r.limits.setConf(cfg)
+	r.cardinality.setConf(cfg)
+	atomic.StoreInt64(&r.wait, int64(cfg.ReceiverWait))
+}
+
+// Queues a logplex body for parsing. If the inbox is full it
+// waits up to the configured time for room and then gives up
+// with ErrInboxFull, so callers can push back on their clients.
+func (r *Receiver) Receive(b []byte, opts map[string][]string) error {
+	r.inboxLock.RLock()
+	defer r.inboxLock.RUnlock()
+	if r.stopped {
+		return ErrStopped
+	}
 	r.inFlight.Add(1)
-	r.Inbox <- &LogRequest{b, opts}
+	req := &LogRequest{b, opts}
+	select {
+	case r.Inbox <- req:
+		return nil
+	default:
+	}
+	// The inbox is full. Wait a little for the accept
+	// routines to catch up rather than holding the
+	// caller until the client gives up.
+	if wait := time.Duration(atomic.LoadInt64(&r.wait)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case r.Inbox <- req:
+			return nil
+		case <-timer.C:
+		}
+	}
+	r.inFlight.Done()
+	r.Mchan.Measure("receiver.reject", 1)
+	return ErrInboxFull
 }
 
 // Start moving data through the receiver's pipeline.
-func (r *Receiver) Start() {
+// The receiver drains and stops when ctx is done or
+// Stop is called.
+func (r *Receiver) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
 	// Accepting the data involves parsing logs messages
 	// into buckets. It is mostly CPU bound, so
 	// it makes sense to parallelize this to the extent
 	// of the number of CPUs.
 	for i := 0; i < r.NumOutlets; i++ {
+		r.accepting.Add(1)
 		go r.accept()
 	}
 	// Outletting data to the store involves sending
@@ -101,13 +184,20 @@ func (r *Receiver) Start() {
 	// add more threads here since it is likely that
 	// they will be blocking on I/O.
 	for i := 0; i < r.NumOutlets; i++ {
+		r.outleting.Add(1)
 		go r.outlet()
 	}
 	r.TransferTicker = time.NewTicker(r.FlushInterval)
 	// The transfer is not a concurrent process.
 	// It removes buckets from the register to the outbox.
-	go r.scheduleTransfer()
-	go r.Report()
+	r.background.Add(2)
+	go r.scheduleTransfer(ctx)
+	go r.Report(ctx)
+	go func() {
+		<-ctx.Done()
+		r.drain()
+		close(r.done)
+	}()
 }
 
 // This function can be used as
@@ -117,7 +207,32 @@ func (r *Receiver) Wait() {
 	r.inFlight.Wait()
 }
 
+// Drains the pipeline into the store. Requests already in the
+// inbox are parsed, the register gets a final transfer and Stop
+// returns once every bucket has been put in the store. Anything
+// received afterwards is dropped, so callers should stop their
+// HTTP server and listeners first. Open syslog connections are
+// closed and their messages read before the pipeline drains.
+func (r *Receiver) Stop() {
+	r.closeConns()
+	r.cancel()
+	<-r.done
+}
+
+func (r *Receiver) drain() {
+	r.inboxLock.Lock()
+	r.stopped = true
+	close(r.Inbox)
+	r.inboxLock.Unlock()
+	r.background.Wait()
+	r.accepting.Wait()
+	r.finalTransfer()
+	close(r.Outbox)
+	r.outleting.Wait()
+}
+
 func (r *Receiver) accept() {
+	defer r.accepting.Done()
 	for req := range r.Inbox {
 		rdr := bufio.NewReader(bytes.NewReader(req.Body))
 		//TODO(DataDog): Use a cached store time.
@@ -137,42 +252,124 @@ func (r *Receiver) accept() {
 		storeTime := time.Now()
 		startParse := time.Now()
 		for b := range parser.BuildBuckets(rdr, req.Opts, r.Mchan) {
-			if b.Id.Delay(storeTime) <= r.deadline {
-				r.inFlight.Add(1)
-				r.addRegister(b)
-			} else {
-				r.Mchan.Measure("receiver.drop", 1)
-			}
+			r.admit(b, storeTime)
 		}
 		r.Mchan.Time("receiver.accept", startParse)
 		r.inFlight.Done()
 	}
 }
 
+// Reads StatsD and DogStatsD datagrams from conn until the
+// connection is closed. UDP carries no authorization, so every
+// datagram is attributed to the credential in opts["auth"].
+func (r *Receiver) ServeStatsd(conn net.PacketConn, opts map[string][]string) error {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		r.receiveStatsd(buf[:n], opts)
+	}
+}
+
+func (r *Receiver) receiveStatsd(b []byte, opts map[string][]string) {
+	startParse := time.Now()
+	var user string
+	if len(opts["auth"]) > 0 {
+		user, _ = r.auths.user(opts["auth"][0])
+	}
+	if !r.allowMessage(user) {
+		return
+	}
+	storeTime := time.Now()
+	for _, b := range parser.BuildStatsdBuckets(b, opts, r.Mchan) {
+		r.admit(b, storeTime)
+	}
+	r.Mchan.Time("receiver.statsd.accept", startParse)
+}
+
+// Applies the request limit to a StatsD datagram or syslog
+// message. Their senders can't be told to back off, so
+// messages over the limit are dropped.
+func (r *Receiver) allowMessage(user string) bool {
+	if ok, _ := r.limits.allowRequest(user, time.Now()); !ok {
+		r.Mchan.CountThrottle(user, "requests")
+		return false
+	}
+	return true
+}
+
+// Adds the bucket to the register unless it is
+// past the receiver's deadline.
+func (r *Receiver) admit(b *bucket.Bucket, storeTime time.Time) {
+	if b.Id.Delay(storeTime) <= r.deadline {
+		r.inFlight.Add(1)
+		r.addRegister(b)
+	} else {
+		r.Mchan.Measure("receiver.drop", 1)
+	}
+}
+
 func (r *Receiver) addRegister(b *bucket.Bucket) {
+	// Decrypting can be slow the first time a
+	// credential is seen, so do it outside the lock.
+	var user string
+	limited := r.limits.limitsBuckets()
+	if limited || r.cardinality.enabled() {
+		user, _ = r.auths.user(b.Id.Auth)
+	}
+	// Folding into the other bucket changes the Id,
+	// so this has to happen before we look it up.
+	if !r.cardinality.admit(user, b.Id, r.Mchan) {
+		r.inFlight.Done()
+		return
+	}
 	r.Register.Lock()
 	defer r.Register.Unlock()
 	atomic.AddUint64(&r.numBuckets, 1)
+	if r.Register.closed {
+		r.Mchan.Measure("receiver.drop", 1)
+		r.inFlight.Done()
+		return
+	}
 	k := *b.Id
 	_, present := r.Register.m[k]
 	if !present {
+		if limited && !r.limits.allowBucket(user, time.Now()) {
+			r.Mchan.CountThrottle(user, "buckets")
+			r.inFlight.Done()
+			return
+		}
 		r.Mchan.Measure("receiver.add-bucket", 1)
 		r.Register.m[k] = b
 	} else {
 		r.Mchan.Measure("receiver.merge-bucket", 1)
 		r.Register.m[k].Merge(b)
+		// Only the bucket in the register reaches the outbox.
+		r.inFlight.Done()
 	}
 }
 
-func (r *Receiver) scheduleTransfer() {
-	for _ = range r.TransferTicker.C {
-		r.transfer()
+func (r *Receiver) scheduleTransfer(ctx context.Context) {
+	defer r.background.Done()
+	defer r.TransferTicker.Stop()
+	for {
+		select {
+		case <-r.TransferTicker.C:
+			r.transfer()
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 func (r *Receiver) transfer() {
 	r.Register.Lock()
 	defer r.Register.Unlock()
+	if r.Register.closed {
+		return
+	}
 	for k := range r.Register.m {
 		if m, ok := r.Register.m[k]; ok {
 			delete(r.Register.m, k)
@@ -181,7 +378,17 @@ func (r *Receiver) transfer() {
 	}
 }
 
+// Transfers whatever is left in the register and
+// closes it to further buckets.
+func (r *Receiver) finalTransfer() {
+	r.transfer()
+	r.Register.Lock()
+	r.Register.closed = true
+	r.Register.Unlock()
+}
+
 func (r *Receiver) outlet() {
+	defer r.outleting.Done()
 	for b := range r.Outbox {
 		startPut := time.Now()
 		if err := r.Store.Put(b); err != nil {
@@ -206,7 +413,7 @@ func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// can extract the username and password from
 	// the auth to use it against the Librato API.
 	authLine, ok := req.Header["Authorization"]
-	if !ok && len(authLine) > 0 {
+	if !ok || len(authLine) == 0 {
 		fmt.Printf("error=%q\n", "Missing authorization header.")
 		http.Error(w, "Missing Auth.", 400)
 		return
@@ -217,13 +424,24 @@ func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Fail: Parse auth.", 400)
 		return
 	}
-	var creds string
-	if creds, err = auth.Decrypt(parseRes); err != nil {
+	var creds *auth.Credential
+	if creds, err = auth.DecryptCredential(parseRes); err != nil {
 		fmt.Printf("error=%s\n", err)
 		http.Error(w, "Invalid Request", 400)
 		return
 	}
-	defer r.Mchan.CountReq(strings.Split(creds, ":")[0])
+	user := creds.User()
+	defer r.Mchan.CountReq(user)
+	if ok, wait := r.limits.allowRequest(user, time.Now()); !ok {
+		r.Mchan.CountThrottle(user, "requests")
+		secs := int(math.Ceil(wait.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		http.Error(w, "Rate limit exceeded", 429)
+		return
+	}
 	v := req.URL.Query()
 	v.Add("auth", parseRes)
 	b, err := ioutil.ReadAll(req.Body)
@@ -233,13 +451,27 @@ func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Invalid Request", 400)
 		return
 	}
-	r.Receive(b, v)
+	switch err := r.Receive(b, v); err {
+	case ErrInboxFull:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Receiver is saturated", 503)
+	case ErrStopped:
+		http.Error(w, "Shutting down", 503)
+	}
 }
 
 // Keep an eye on the lenghts of our bufferes.
 // If they are maxed out, something is going wrong.
-func (r *Receiver) Report() {
-	for _ = range time.Tick(time.Second) {
+func (r *Receiver) Report(ctx context.Context) {
+	defer r.background.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
 		nb := atomic.LoadUint64(&r.numBuckets)
 		nr := atomic.LoadUint64(&r.numReqs)
 		atomic.AddUint64(&r.numBuckets, -nb)
@@ -249,5 +481,7 @@ func (r *Receiver) Report() {
 		pre := "receiver.buffer."
 		r.Mchan.Measure(pre+"inbox", float64(len(r.Inbox)))
 		r.Mchan.Measure(pre+"outbox", float64(len(r.Outbox)))
+		r.limits.prune(time.Now())
+		r.cardinality.prune(time.Now())
 	}
 }
@@ -0,0 +1,102 @@
+package receiver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/store"
+	"github.com/kr/fernet"
+)
+
+func logLine(msg string) []byte {
+	line := fmt.Sprintf("<174>1 %s somehost name test - %s",
+		time.Now().UTC().Format(time.RFC3339), msg)
+	return []byte(fmt.Sprintf("%d %s", len(line), line))
+}
+
+// Returns an Authorization header for creds
+// encrypted with a freshly installed key.
+func basicAuth(t *testing.T, creds string) string {
+	var k fernet.Key
+	if err := auth.SetKeys([]string{k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := auth.EncryptAndSign([]byte(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Basic " + base64.URLEncoding.EncodeToString(append(tok, ':'))
+}
+
+func TestStopDrainsRegister(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:      2,
+		BufferSize:       10,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+	}
+	st := store.NewMemStore()
+	recv := NewReceiver(cfg, st)
+	recv.Mchan = new(metchan.Channel)
+	recv.Start(context.Background())
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	recv.Receive(logLine("measure#a=1 measure#b=2"), opts)
+	recv.Receive(logLine("measure#a=3"), opts)
+	recv.Stop()
+
+	// The flush interval never elapsed, so everything in the
+	// store got there by way of the final transfer.
+	ch, err := st.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for b := range ch {
+		counts[b.Id.Name] += b.Count()
+	}
+	if counts["a"] != 2 || counts["b"] != 1 {
+		t.Errorf("actual=%v expected=map[a:2 b:1]\n", counts)
+	}
+	if err := recv.Receive(logLine("measure#a=1"), opts); err != ErrStopped {
+		t.Errorf("actual-err=%v expected-err=%v\n", err, ErrStopped)
+	}
+	recv.Wait()
+}
+
+func TestReceiveInboxFull(t *testing.T) {
+	cfg := &conf.D{
+		BufferSize:   1,
+		ReceiverWait: 10 * time.Millisecond,
+	}
+	// Not started, so nothing drains the inbox.
+	recv := NewReceiver(cfg, nil)
+	recv.Mchan = new(metchan.Channel)
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	if err := recv.Receive(logLine("measure#a=1"), opts); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := recv.Receive(logLine("measure#a=1"), opts); err != ErrInboxFull {
+		t.Errorf("actual-err=%v expected-err=%v\n", err, ErrInboxFull)
+	}
+	if waited := time.Since(start); waited < cfg.ReceiverWait {
+		t.Errorf("actual-wait=%s expected at least %s\n", waited, cfg.ReceiverWait)
+	}
+
+	req := httptest.NewRequest("POST", "/logs", strings.NewReader(""))
+	req.Header.Set("Authorization", basicAuth(t, "app:pass"))
+	w := httptest.NewRecorder()
+	recv.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("actual=%d,%q expected=503,\"1\"\n", w.Code, w.Header().Get("Retry-After"))
+	}
+}
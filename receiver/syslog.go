@@ -0,0 +1,179 @@
+package receiver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/parser"
+)
+
+// Largest syslog message we are willing to buffer.
+const maxSyslogMsg = 64 * 1024
+
+// Remembers the users that credentials decrypt to so that
+// we don't pay for decryption on every message.
+type authCache struct {
+	auth.Cache
+}
+
+// Returns the user in the decrypted credential,
+// without any password.
+func (c *authCache) user(a string) (string, bool) {
+	cred, err := c.Get(a)
+	if err != nil {
+		return "", false
+	}
+	return cred.User(), true
+}
+
+// Accepts syslog connections on l until the listener is closed.
+// Each connection may use octet-counting or newline framing
+// (RFC6587); the framing is detected per message.
+// The defaults in opts are used when a message doesn't carry
+// its own l2met structured data.
+func (r *Receiver) ServeSyslogTCP(l net.Listener, opts map[string][]string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if !r.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		go r.readSyslogConn(conn, opts)
+	}
+}
+
+// Adds conn to the connections Stop closes. Reports false
+// once Stop has closed them.
+func (r *Receiver) trackConn(conn net.Conn) bool {
+	r.connsLock.Lock()
+	defer r.connsLock.Unlock()
+	if r.connsDone {
+		return false
+	}
+	r.conns[conn] = true
+	r.connReaders.Add(1)
+	return true
+}
+
+// Reports whether the connection was closed by Stop.
+func (r *Receiver) untrackConn(conn net.Conn) bool {
+	r.connsLock.Lock()
+	defer r.connsLock.Unlock()
+	delete(r.conns, conn)
+	return r.connsDone
+}
+
+// Closes the open syslog connections and waits
+// for their messages to be received.
+func (r *Receiver) closeConns() {
+	r.connsLock.Lock()
+	r.connsDone = true
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.connsLock.Unlock()
+	r.connReaders.Wait()
+}
+
+func (r *Receiver) readSyslogConn(conn net.Conn, opts map[string][]string) {
+	defer r.connReaders.Done()
+	defer conn.Close()
+	rdr := bufio.NewReaderSize(conn, maxSyslogMsg)
+	for {
+		msg, err := readSyslogFrame(rdr)
+		if err != nil {
+			if stopped := r.untrackConn(conn); err != io.EOF && !stopped {
+				fmt.Printf("error=syslog-read remote=%s msg=%s\n",
+					conn.RemoteAddr(), err)
+			}
+			return
+		}
+		r.receiveSyslog(msg, opts)
+	}
+}
+
+// Reads a single octet-counted or newline terminated frame.
+func readSyslogFrame(rdr *bufio.Reader) ([]byte, error) {
+	c, err := rdr.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if c[0] < '0' || c[0] > '9' {
+		line, err := rdr.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("syslog: frame too large")
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		return append([]byte{}, line...), nil
+	}
+	l, err := rdr.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(l[:len(l)-1])
+	if err != nil || n > maxSyslogMsg {
+		return nil, errors.New("syslog: malformed octet count")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(rdr, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Reads syslog datagrams from conn until it is closed.
+// Each datagram holds exactly one message.
+func (r *Receiver) ServeSyslogUDP(conn net.PacketConn, opts map[string][]string) error {
+	buf := make([]byte, maxSyslogMsg)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		r.receiveSyslog(buf[:n], opts)
+	}
+}
+
+func (r *Receiver) receiveSyslog(b []byte, defaults map[string][]string) {
+	startParse := time.Now()
+	msg, err := parser.ParseSyslog(b)
+	if err != nil {
+		r.Mchan.Measure("receiver.syslog.error", 1)
+		return
+	}
+	opts := make(map[string][]string, len(defaults)+len(msg.Params))
+	for k, v := range defaults {
+		opts[k] = v
+	}
+	for k, v := range msg.Params {
+		opts[k] = v
+	}
+	if len(opts["auth"]) == 0 {
+		r.Mchan.Measure("receiver.syslog.unauthorized", 1)
+		return
+	}
+	user, ok := r.auths.user(opts["auth"][0])
+	if !ok {
+		r.Mchan.Measure("receiver.syslog.unauthorized", 1)
+		return
+	}
+	if !r.allowMessage(user) {
+		return
+	}
+	storeTime := time.Now()
+	for b := range parser.BuildSyslogBuckets(msg, opts, r.Mchan) {
+		r.admit(b, storeTime)
+	}
+	r.Mchan.Time("receiver.syslog.accept", startParse)
+}
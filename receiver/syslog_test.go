@@ -0,0 +1,106 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/l2met/auth"
+	"github.com/DataDog/l2met/conf"
+	"github.com/DataDog/l2met/metchan"
+	"github.com/DataDog/l2met/store"
+)
+
+func TestReadSyslogFrame(t *testing.T) {
+	in := "11 <13>a b c d<13>e f g\n<13>h i j"
+	expected := []string{"<13>a b c d", "<13>e f g\n", "<13>h i j"}
+	rdr := bufio.NewReader(bytes.NewBufferString(in))
+	for i := range expected {
+		msg, err := readSyslogFrame(rdr)
+		if err != nil {
+			t.Fatalf("frame=%d error=%s\n", i, err)
+		}
+		if string(msg) != expected[i] {
+			t.Errorf("actual=%q expected=%q\n", msg, expected[i])
+		}
+	}
+	if _, err := readSyslogFrame(rdr); err != io.EOF {
+		t.Errorf("actual-err=%v expected-err=EOF\n", err)
+	}
+}
+
+func TestStopClosesSyslogConns(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       10,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+	}
+	st := store.NewMemStore()
+	recv := NewReceiver(cfg, st)
+	recv.Mchan = new(metchan.Channel)
+	recv.Start(context.Background())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Installs a key for the token below.
+	basicAuth(t, "app:pass")
+	tok, err := auth.EncryptAndSign([]byte("app:pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := map[string][]string{"auth": []string{string(tok)}}
+	go recv.ServeSyslogTCP(l, opts)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := "<174>1 " + time.Now().UTC().Format(time.RFC3339) +
+		" somehost app web.1 - - measure#a=1\n"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the message to reach the register
+	// so that Stop is what ends the connection.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		recv.Register.Lock()
+		n := len(recv.Register.m)
+		recv.Register.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("message never reached the register\n")
+		}
+	}
+	l.Close()
+	recv.Stop()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("actual-err=%v expected-err=EOF\n", err)
+	}
+	recv.connsLock.Lock()
+	open := len(recv.conns)
+	recv.connsLock.Unlock()
+	if open != 0 {
+		t.Errorf("actual-open=%d expected=0\n", open)
+	}
+	ch, err := st.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for b := range ch {
+		n += b.Count()
+	}
+	if n != 1 {
+		t.Errorf("actual-count=%d expected=1\n", n)
+	}
+}
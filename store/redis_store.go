@@ -139,6 +139,24 @@ func (s *RedisStore) Put(b *bucket.Bucket) error {
 		x := strconv.FormatFloat(b.Vals[i], 'f', 10, 64)
 		payload[i+1] = []byte(x)
 	}
+	// Unique buckets carry a sketch instead of values.
+	// Every receiver pushes its own sketch and Get merges them.
+	if b.Hll != nil {
+		sketch, err := b.Hll.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		payload = append(payload, sketch)
+	}
+	// Large measurement buckets are sent as a single sketch
+	// instead of one element per value.
+	if b.Sketch != nil {
+		sketch, err := b.Sketch.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		payload = append(payload, sketch)
+	}
 
 	p := namePartition(b.Id.ReadyAt, b.Id.Partition(s.maxPartitions))
 	rc.Send("MULTI")
@@ -169,9 +187,25 @@ func (s *RedisStore) Get(b *bucket.Bucket) error {
 	if len(reply) == 0 {
 		return errors.New("redis_store: Empty bucket.")
 	}
+	if b.Id.Type == "unique" {
+		for i := range reply {
+			h := new(bucket.HLL)
+			if err := h.UnmarshalBinary(reply[i].([]byte)); err == nil {
+				b.MergeHll(h)
+			}
+		}
+		return nil
+	}
 	b.Vals = make([]float64, 0, len(reply))
 	for i := range reply {
 		numstr := reply[i].([]byte)
+		if bucket.IsSketch(numstr) {
+			sk := bucket.NewSketch()
+			if err := sk.UnmarshalBinary(numstr); err == nil {
+				b.MergeSketch(sk)
+			}
+			continue
+		}
 		numf, err := strconv.ParseFloat(string(numstr), 64)
 		if err == nil {
 			b.Append(numf)
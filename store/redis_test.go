@@ -97,3 +97,56 @@ func TestRedisLockPartition(t *testing.T) {
 		t.Errorf("Unable to lock partition.")
 	}
 }
+
+func TestRedisGetUnique(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	id := &bucket.Id{Name: "test", Type: "unique"}
+	for _, v := range []string{"a", "b", "a"} {
+		b := &bucket.Bucket{Id: id}
+		b.AddUnique(v)
+		if err := st.Put(b); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	b := &bucket.Bucket{Id: id}
+	if err := st.Get(b); err != nil {
+		t.Error(err)
+	}
+	if b.Unique() != 2 {
+		t.Errorf("expected=2 actual=%d\n", b.Unique())
+	}
+}
+
+func TestRedisGetSketch(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	id := &bucket.Id{Name: "test", Type: "measurement"}
+	b1 := &bucket.Bucket{Id: id}
+	for i := 0; i <= bucket.SketchThreshold; i++ {
+		b1.Append(float64(i))
+	}
+	if b1.Sketch == nil {
+		t.Fatal("Expected b1 to use a sketch.")
+	}
+	// A second receiver with raw values.
+	b2 := &bucket.Bucket{Id: id, Vals: []float64{1000}}
+	for _, b := range []*bucket.Bucket{b1, b2} {
+		if err := st.Put(b); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	b3 := &bucket.Bucket{Id: id}
+	if err := st.Get(b3); err != nil {
+		t.Error(err)
+	}
+	if b3.Count() != b1.Count()+1 || b3.Max() != 1000 {
+		t.Errorf("actual-count=%d actual-max=%f\n", b3.Count(), b3.Max())
+	}
+}